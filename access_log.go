@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+type AccessEntry struct {
+	Time     int64             `json:"time"`
+	Action   string            `json:"action"`
+	Steam    string            `json:"steam"`
+	Name     string            `json:"name"`
+	Roles    []string          `json:"roles"`
+	IP       string            `json:"ip"`
+	Cluster  string            `json:"cluster,omitempty"`
+	Server   string            `json:"server,omitempty"`
+	Params   map[string]string `json:"params,omitempty"`
+	Duration int64             `json:"duration,omitempty"`
+}
+
+var accessLogMutex sync.Mutex
+
+// logAccess records an authenticated request together with its route parameters
+func logAccess(c *gin.Context, action string) {
+	session := getSession(c)
+	if session == nil {
+		return
+	}
+
+	params := make(map[string]string)
+	for _, param := range c.Params {
+		params[param.Key] = param.Value
+	}
+
+	for key, values := range c.Request.URL.Query() {
+		// Never store credentials in the audit log
+		if key == "token" || key == "ott" || len(values) == 0 {
+			continue
+		}
+
+		params[key] = values[0]
+	}
+
+	writeAccessEntry(AccessEntry{
+		Time:    time.Now().Unix(),
+		Action:  action,
+		Steam:   session.Steam,
+		Name:    session.Name,
+		Roles:   session.Roles,
+		IP:      c.ClientIP(),
+		Cluster: c.Query("cluster"),
+		Server:  c.Param("server"),
+		Params:  params,
+	})
+}
+
+// logConnectionOpen records a new socket connection, so it is known even if the connection is never closed properly
+func logConnectionOpen(server string, conn *Connection) {
+	if conn.Session == nil {
+		return
+	}
+
+	writeAccessEntry(AccessEntry{
+		Time:    conn.ConnectedAt.Unix(),
+		Action:  "socket/" + conn.Type + "/connect",
+		Steam:   conn.Steam,
+		Name:    conn.Name,
+		Roles:   conn.Session.Roles,
+		IP:      conn.IP,
+		Cluster: conn.Cluster,
+		Server:  server,
+	})
+}
+
+// logConnectionAccess records a closed socket connection and how long it was open (since the last split)
+func logConnectionAccess(server string, conn *Connection) {
+	conn.Mutex.Lock()
+	since := conn.loggedSince
+	conn.Mutex.Unlock()
+
+	writeConnectionAccess(server, conn, since, time.Now())
+}
+
+// splitConnectionAccess logs connections that would be open for longer than maxRecordDuration by the next ping and
+// continues them from now on, so like flag records and vehicle sessions no entry is longer than maxRecordDuration
+func splitConnectionAccess(server string, conn *Connection, now time.Time) {
+	conn.Mutex.Lock()
+	since := conn.loggedSince
+	if now.Add(socketPingInterval).Unix()-since.Unix() <= maxRecordDuration {
+		conn.Mutex.Unlock()
+		return
+	}
+
+	conn.loggedSince = now
+	conn.Mutex.Unlock()
+
+	writeConnectionAccess(server, conn, since, now)
+}
+
+func writeConnectionAccess(server string, conn *Connection, since, now time.Time) {
+	if conn.Session == nil {
+		return
+	}
+
+	writeAccessEntry(AccessEntry{
+		Time:     since.Unix(),
+		Action:   "socket/" + conn.Type,
+		Steam:    conn.Steam,
+		Name:     conn.Name,
+		Roles:    conn.Session.Roles,
+		IP:       conn.IP,
+		Cluster:  conn.Cluster,
+		Server:   server,
+		Duration: int64(now.Sub(since).Seconds()),
+	})
+}
+
+func writeAccessEntry(entry AccessEntry) {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		log.Warning("Failed to encode access log entry: " + err.Error())
+		return
+	}
+
+	dir := config.AuditPath + "/access/"
+	path := dir + time.Now().Format("2006-01-02") + ".jsonl"
+
+	accessLogMutex.Lock()
+	defer accessLogMutex.Unlock()
+
+	_ = os.MkdirAll(dir, 0777)
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0777)
+	if err != nil {
+		log.Warning("Failed to open access log: " + err.Error())
+		return
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	_, err = file.Write(append(b, '\n'))
+	if err != nil {
+		log.Warning("Failed to write access log: " + err.Error())
+	}
+}
+
+// getAccessEntries returns all access log entries within the given time range, optionally filtered by steam identifier and action
+func getAccessEntries(from, till int64, steam, action string) ([]AccessEntry, error) {
+	if till < from {
+		return nil, errors.New("till is before from")
+	}
+
+	if till-from > 31*24*60*60 {
+		return nil, errors.New("maximum range is 31 days")
+	}
+
+	entries := make([]AccessEntry, 0)
+
+	accessLogMutex.Lock()
+	defer accessLogMutex.Unlock()
+
+	// Socket connections are logged when they are closed (or split), which can be a day after they were opened
+	for _, day := range recordDays(from, till) {
+		path := config.AuditPath + "/access/" + day.Format("2006-01-02") + ".jsonl"
+
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, errors.New("failed to read data")
+		}
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var entry AccessEntry
+
+			err = json.Unmarshal(scanner.Bytes(), &entry)
+			if err != nil {
+				log.Warning("Failed to read access log entry")
+				continue
+			}
+
+			if entry.Time >= from && entry.Time <= till && (steam == "" || entry.Steam == steam) && (action == "" || entry.Action == action) {
+				entries = append(entries, entry)
+			}
+		}
+
+		_ = file.Close()
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Time < entries[j].Time
+	})
+
+	return entries, nil
+}
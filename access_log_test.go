@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConnectionAccessSplit(t *testing.T) {
+	useTestConfig(t, "")
+
+	now := time.Now()
+	opened := now.Add(-24*time.Hour + 10*time.Second)
+
+	conn := &Connection{
+		Cluster: "c1",
+		Type:    SocketTypeMap,
+		Steam:   "steam:11000010a1b2c3d",
+		Session: &Session{Steam: "steam:11000010a1b2c3d", Roles: []string{RoleSenior}},
+
+		ConnectedAt: opened,
+		loggedSince: opened,
+	}
+
+	splitConnectionAccess("c1s1", conn, now.Add(-time.Minute))
+	if !conn.loggedSince.Equal(opened) {
+		t.Fatal("expected the connection not to be split before it is open for 24 hours")
+	}
+
+	// The connection would be open for longer than 24 hours by the next ping
+	splitConnectionAccess("c1s1", conn, now)
+	if !conn.loggedSince.Equal(now) {
+		t.Fatalf("expected the connection to be split now, got %s", conn.loggedSince)
+	}
+
+	splitConnectionAccess("c1s1", conn, now.Add(socketPingInterval))
+	if !conn.loggedSince.Equal(now) {
+		t.Fatal("expected the connection to only be split once a day")
+	}
+
+	logConnectionAccess("c1s1", conn)
+
+	// The first part is written today, but started the day before
+	entries, err := getAccessEntries(opened.Unix(), opened.Unix(), "", "socket/map")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 || entries[0].Duration != 24*60*60-10 || entries[0].Steam != conn.Steam {
+		t.Fatalf("expected the first part of the connection, got %+v", entries)
+	}
+
+	entries, err = getAccessEntries(opened.Unix(), now.Unix(), "steam:11000010a1b2c3d", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 2 || entries[1].Time != now.Unix() {
+		t.Errorf("expected both parts of the connection, got %+v", entries)
+	}
+}
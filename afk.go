@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type AFKState struct {
+	X     float64 `json:"x"`
+	Y     float64 `json:"y"`
+	Z     float64 `json:"z"`
+	Since int64   `json:"since"`
+
+	// Reported is true once an AFK start event was emitted for the current session
+	Reported bool `json:"reported"`
+}
+
+type AFKEvent struct {
+	Type     string `json:"type"`
+	Steam    string `json:"steam"`
+	Since    int64  `json:"since"`
+	Duration int64  `json:"duration"`
+	Time     int64  `json:"time"`
+}
+
+type AFKSession struct {
+	Start    int64 `json:"start"`
+	End      int64 `json:"end"`
+	Duration int64 `json:"duration"`
+}
+
+type AFKPlayer struct {
+	Steam string `json:"steam"`
+	Since int64  `json:"since"`
+	AFK   int64  `json:"afk"`
+}
+
+type afkSaveFile struct {
+	Saved   int64                           `json:"saved"`
+	Players map[string]map[string]*AFKState `json:"players"`
+}
+
+const (
+	AFKEventStart = "start"
+	AFKEventEnd   = "end"
+)
+
+var (
+	afkStates    = make(map[string]map[string]*AFKState)
+	afkEvents    = make(map[string][]AFKEvent)
+	afkLastSave  = time.Unix(0, 0)
+	afkMutex     sync.Mutex
+	afkFileMutex sync.Mutex
+)
+
+// afkTolerance is the distance (in game units) a player has to move before they are no longer considered AFK
+func afkTolerance() float64 {
+	return config.AFK.Tolerance
+}
+
+// afkThreshold is the time a player has to stand still before an AFK session is started
+func afkThreshold() time.Duration {
+	return config.AFK.Threshold
+}
+
+func loadAFKState() {
+	b, err := ioutil.ReadFile(config.AFKStateFile)
+	if err != nil {
+		return
+	}
+
+	var save afkSaveFile
+	err = json.Unmarshal(b, &save)
+	if err != nil || save.Players == nil {
+		log.Warning("Ignoring invalid or outdated " + config.AFKStateFile)
+		return
+	}
+
+	// If we were down for too long we can't know whether people moved in the meantime
+	if time.Now().Sub(time.Unix(save.Saved, 0)) > 10*time.Minute {
+		log.Info("Ignoring stale " + config.AFKStateFile)
+
+		// Open sessions are still logged, they lasted at least until the state was saved
+		for server, players := range save.Players {
+			for steam, state := range players {
+				if state == nil || !state.Reported {
+					continue
+				}
+
+				err := logAFKSession(server, steam, AFKSession{
+					Start:    state.Since,
+					End:      save.Saved,
+					Duration: save.Saved - state.Since,
+				})
+				if err != nil {
+					log.Warning("Failed to log AFK session for '" + steam + "': " + err.Error())
+				}
+			}
+		}
+
+		return
+	}
+
+	afkMutex.Lock()
+	afkStates = save.Players
+	afkMutex.Unlock()
+}
+
+func saveAFKState() {
+	afkMutex.Lock()
+	b, err := json.Marshal(afkSaveFile{
+		Saved:   time.Now().Unix(),
+		Players: afkStates,
+	})
+	afkLastSave = time.Now()
+	afkMutex.Unlock()
+
+	if err != nil {
+		log.Warning("Failed to encode AFK state: " + err.Error())
+		return
+	}
+
+	err = ioutil.WriteFile(config.AFKStateFile, b, 0777)
+	if err != nil {
+		log.Warning("Failed to save AFK state: " + err.Error())
+	}
+}
+
+// updateAFK updates the AFK state of a player and returns for how long (in seconds) they have not moved
+func updateAFK(server, steam string, coords *Coords) int64 {
+	if coords == nil {
+		return 0
+	}
+
+	x, y, z := coords.X, coords.Y, coords.Z
+
+	now := time.Now().Unix()
+
+	afkMutex.Lock()
+	defer afkMutex.Unlock()
+
+	if afkStates[server] == nil {
+		afkStates[server] = make(map[string]*AFKState)
+	}
+
+	state, ok := afkStates[server][steam]
+	if !ok || distance3D(state.X, state.Y, state.Z, x, y, z) > afkTolerance() {
+		if ok && state.Reported {
+			endAFKSession(server, steam, state, now)
+		}
+
+		afkStates[server][steam] = &AFKState{
+			X:     x,
+			Y:     y,
+			Z:     z,
+			Since: now,
+		}
+
+		return 0
+	}
+
+	if !state.Reported && now-state.Since >= int64(afkThreshold().Seconds()) {
+		state.Reported = true
+
+		afkEvents[server] = append(afkEvents[server], AFKEvent{
+			Type:     AFKEventStart,
+			Steam:    steam,
+			Since:    state.Since,
+			Duration: now - state.Since,
+			Time:     now,
+		})
+	}
+
+	return now - state.Since
+}
+
+// cleanupAFK ends the sessions of players that are no longer on the server and periodically saves the AFK state
+func cleanupAFK(server string, validIDs map[string]bool) {
+	now := time.Now().Unix()
+
+	afkMutex.Lock()
+	for steam, state := range afkStates[server] {
+		if !validIDs[steam] {
+			if state.Reported {
+				endAFKSession(server, steam, state, now)
+			}
+
+			delete(afkStates[server], steam)
+		}
+	}
+	shouldSave := time.Now().Sub(afkLastSave) > 5*time.Minute
+	afkMutex.Unlock()
+
+	if shouldSave {
+		saveAFKState()
+	}
+}
+
+// endAFKSession has to be called while holding afkMutex
+func endAFKSession(server, steam string, state *AFKState, now int64) {
+	afkEvents[server] = append(afkEvents[server], AFKEvent{
+		Type:     AFKEventEnd,
+		Steam:    steam,
+		Since:    state.Since,
+		Duration: now - state.Since,
+		Time:     now,
+	})
+
+	err := logAFKSession(server, steam, AFKSession{
+		Start:    state.Since,
+		End:      now,
+		Duration: now - state.Since,
+	})
+	if err != nil {
+		log.Warning("Failed to log AFK session for '" + steam + "': " + err.Error())
+	}
+}
+
+// popAFKEvents returns and clears all AFK events that happened since the last call
+func popAFKEvents(server string) []AFKEvent {
+	afkMutex.Lock()
+	events := afkEvents[server]
+	delete(afkEvents, server)
+	afkMutex.Unlock()
+
+	if events == nil {
+		return []AFKEvent{}
+	}
+
+	return events
+}
+
+// getAFKPlayers lists everyone who is AFK for at least threshold seconds, invisible players are only listed for
+// sessions allowed to see them
+func getAFKPlayers(server string, threshold int64, session *Session) []AFKPlayer {
+	now := time.Now().Unix()
+	afk := make([]AFKPlayer, 0)
+
+	afkMutex.Lock()
+	for steam, state := range afkStates[server] {
+		duration := now - state.Since
+
+		if duration >= threshold {
+			afk = append(afk, AFKPlayer{
+				Steam: steam,
+				Since: state.Since,
+				AFK:   duration,
+			})
+		}
+	}
+	afkMutex.Unlock()
+
+	players := afk
+	if !session.Can(PermissionInvisible) {
+		players = make([]AFKPlayer, 0, len(afk))
+
+		for _, player := range afk {
+			if flagActiveSince(server, player.Steam, FlagInvisible) == 0 {
+				players = append(players, player)
+			}
+		}
+	}
+
+	sort.Slice(players, func(i, j int) bool {
+		return players[i].AFK > players[j].AFK
+	})
+
+	return players
+}
+
+func afkSessionPath(server, steam string) (string, string) {
+	dir := config.AFKPath + "/" + server + "/"
+
+	return dir, dir + strings.ReplaceAll(steam, "steam:", "") + ".csv"
+}
+
+func logAFKSession(server, steam string, session AFKSession) error {
+	dir, path := afkSessionPath(server, steam)
+
+	afkFileMutex.Lock()
+	defer afkFileMutex.Unlock()
+
+	_ = os.MkdirAll(dir, 0777)
+
+	_, err := os.Stat(path)
+	existed := err == nil
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0777)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	if !existed {
+		_, _ = file.WriteString("Start,End,Duration\n")
+	}
+
+	_, err = file.WriteString(fmt.Sprintf("%d,%d,%d\n", session.Start, session.End, session.Duration))
+
+	return err
+}
+
+func getAFKSessions(server, steam string, from, till int64) ([]AFKSession, error) {
+	_, path := afkSessionPath(server, steam)
+	sessions := make([]AFKSession, 0)
+
+	afkFileMutex.Lock()
+	defer afkFileMutex.Unlock()
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return sessions, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	scanner := bufio.NewScanner(file)
+	index := 0
+	for scanner.Scan() {
+		elements := strings.Split(scanner.Text(), ",")
+
+		// Skip csv header
+		if index == 0 {
+			index++
+			continue
+		}
+		index++
+
+		if len(elements) == 3 {
+			start, sErr := strconv.ParseInt(elements[0], 10, 64)
+			end, eErr := strconv.ParseInt(elements[1], 10, 64)
+			duration, dErr := strconv.ParseInt(elements[2], 10, 64)
+
+			if sErr != nil || eErr != nil || dErr != nil {
+				log.Warning("Failed to read afk csv entry")
+				continue
+			}
+
+			if end >= from && start <= till {
+				sessions = append(sessions, AFKSession{
+					Start:    start,
+					End:      end,
+					Duration: duration,
+				})
+			}
+		}
+	}
+
+	return sessions, nil
+}
+
+func distance3D(x1, y1, z1, x2, y2, z2 float64) float64 {
+	return math.Sqrt(math.Pow(x2-x1, 2) + math.Pow(y2-y1, 2) + math.Pow(z2-z1, 2))
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestAFKPlayersHideInvisible(t *testing.T) {
+	useTestConfig(t, "")
+
+	server := "c9s2"
+	now := time.Now().Unix()
+
+	afkMutex.Lock()
+	afkStates[server] = map[string]*AFKState{
+		"steam:1": {Since: now - 600, Reported: true},
+		"steam:2": {Since: now - 600, Reported: true},
+	}
+	afkMutex.Unlock()
+
+	trackFlags(server, "steam:2", 2, map[string]bool{FlagInvisible: true}, now-600)
+
+	trial := &Session{Permissions: resolvePermissions([]string{RoleTrial})}
+	superadmin := &Session{Permissions: resolvePermissions([]string{RoleSuperAdmin})}
+
+	if trial.Can(PermissionInvisible) || !superadmin.Can(PermissionInvisible) {
+		t.Fatal("expected superadmins but not trials to see invisible players")
+	}
+
+	players := getAFKPlayers(server, 300, trial)
+	if len(players) != 1 || players[0].Steam != "steam:1" {
+		t.Errorf("expected only the visible player, got %+v", players)
+	}
+
+	players = getAFKPlayers(server, 300, superadmin)
+	if len(players) != 2 {
+		t.Errorf("expected both players, got %+v", players)
+	}
+
+	if players = getAFKPlayers(server, 900, superadmin); len(players) != 0 {
+		t.Errorf("expected nobody to be AFK for 15 minutes, got %+v", players)
+	}
+}
+
+func TestAFKSessions(t *testing.T) {
+	useTestConfig(t, "")
+
+	server := "c9s5"
+	steam := "steam:11000010a1b2c3d"
+
+	if afk := updateAFK(server, steam, &Coords{X: 100, Y: 200, Z: 30}); afk != 0 {
+		t.Fatalf("expected a new player not to be AFK, got %d", afk)
+	}
+
+	// Standing still for longer than the threshold starts a session
+	now := time.Now().Unix()
+
+	afkMutex.Lock()
+	afkStates[server][steam].Since = now - 400
+	afkMutex.Unlock()
+
+	if afk := updateAFK(server, steam, &Coords{X: 100, Y: 200, Z: 30}); afk < 400 {
+		t.Fatalf("expected to be AFK for 400 seconds, got %d", afk)
+	}
+
+	// Moving within the tolerance keeps the session going
+	if afk := updateAFK(server, steam, &Coords{X: 101, Y: 200.5, Z: 30}); afk < 400 {
+		t.Fatalf("expected small movements to be ignored, got %d", afk)
+	}
+
+	events := popAFKEvents(server)
+	if len(events) != 1 || events[0].Type != AFKEventStart || events[0].Since != now-400 {
+		t.Fatalf("expected a single start event, got %+v", events)
+	}
+
+	if afk := updateAFK(server, steam, &Coords{X: 110, Y: 200, Z: 30}); afk != 0 {
+		t.Fatalf("expected moving to end the session, got %d", afk)
+	}
+
+	events = popAFKEvents(server)
+	if len(events) != 1 || events[0].Type != AFKEventEnd || events[0].Duration < 400 {
+		t.Fatalf("expected an end event, got %+v", events)
+	}
+
+	sessions, err := getAFKSessions(server, steam, now-3600, now+60)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sessions) != 1 || sessions[0].Start != now-400 || sessions[0].Duration < 400 {
+		t.Errorf("expected the session to be logged, got %+v", sessions)
+	}
+
+	// Players that are no longer on the server end their session as well
+	afkMutex.Lock()
+	afkStates[server][steam] = &AFKState{Since: now - 900, Reported: true}
+	afkMutex.Unlock()
+
+	cleanupAFK(server, map[string]bool{})
+
+	events = popAFKEvents(server)
+	if len(events) != 1 || events[0].Type != AFKEventEnd || events[0].Since != now-900 {
+		t.Errorf("expected leaving to end the session, got %+v", events)
+	}
+
+	if sessions, _ = getAFKSessions(server, steam, now-3600, now+60); len(sessions) != 2 {
+		t.Errorf("expected two sessions, got %+v", sessions)
+	}
+}
+
+func TestStaleAFKState(t *testing.T) {
+	useTestConfig(t, "")
+
+	server := "c9s6"
+	saved := time.Now().Add(-time.Hour).Unix()
+
+	b, _ := json.Marshal(afkSaveFile{
+		Saved: saved,
+		Players: map[string]map[string]*AFKState{
+			server: {
+				"steam:1": {Since: saved - 600, Reported: true},
+				"steam:2": {Since: saved - 60},
+			},
+		},
+	})
+
+	err := ioutil.WriteFile(config.AFKStateFile, b, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loadAFKState()
+
+	afkMutex.Lock()
+	_, loaded := afkStates[server]
+	afkMutex.Unlock()
+
+	if loaded {
+		t.Error("expected stale AFK state to be ignored")
+	}
+
+	// Sessions that were still open are logged until the state was saved
+	sessions, _ := getAFKSessions(server, "steam:1", saved-3600, saved)
+	if len(sessions) != 1 || sessions[0].End != saved || sessions[0].Duration != 600 {
+		t.Errorf("expected the open session to be logged, got %+v", sessions)
+	}
+
+	if sessions, _ = getAFKSessions(server, "steam:2", saved-3600, saved); len(sessions) != 0 {
+		t.Errorf("expected players that weren't AFK yet not to be logged, got %+v", sessions)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Session is an authenticated panel session, resolved by one of the authentication backends
+type Session struct {
+	ID          string
+	Steam       string
+	Name        string
+	Roles       []string
+	Permissions map[string]bool
+	Claims      map[string]interface{}
+
+	token string
+}
+
+// Authenticator validates a session token for the given cluster
+type Authenticator interface {
+	Authenticate(token, cluster string) (*Session, error)
+	Name() string
+}
+
+var (
+	authenticator Authenticator
+
+	errInvalidSession = errors.New("invalid session")
+)
+
+// newAuthenticator creates the configured authentication backend
+func newAuthenticator(cfg AuthConfig) (Authenticator, error) {
+	switch cfg.Backend {
+	case "file":
+		return newFileAuthenticator(config.PanelRoot)
+	case "redis":
+		return newRedisAuthenticator(cfg.Redis)
+	case "jwt":
+		return newJWTAuthenticator(cfg.JWTSecret)
+	}
+
+	return nil, errors.New("unknown auth backend '" + cfg.Backend + "'")
+}
+
+// FileAuthenticator authenticates against the session files of a panel running on the same host
+type FileAuthenticator struct {
+	Directory string
+}
+
+func newFileAuthenticator(panelRoot string) (*FileAuthenticator, error) {
+	root := strings.TrimRight(panelRoot, string(os.PathSeparator))
+	directory := root + "/storage/framework/session_storage"
+
+	stat, err := os.Stat(directory)
+	if err != nil || !stat.IsDir() {
+		return nil, errors.New("failed to read PanelRoot '" + directory + "'")
+	}
+
+	return &FileAuthenticator{
+		Directory: directory,
+	}, nil
+}
+
+func (a *FileAuthenticator) Name() string {
+	return "file (" + a.Directory + ")"
+}
+
+func (a *FileAuthenticator) Authenticate(token, cluster string) (*Session, error) {
+	token = sanitizeSessionID(token)
+	if token == "" {
+		return nil, errInvalidSession
+	}
+
+	sessionFile := a.Directory + "/" + cluster + token + ".session"
+	b, err := ioutil.ReadFile(sessionFile)
+	if err != nil {
+		log.Debug("Unable to find '" + sessionFile + "'")
+		return nil, errInvalidSession
+	}
+
+	return sessionFromData(cluster+token, b)
+}
+
+func sanitizeSessionID(session string) string {
+	rgx := regexp.MustCompile(`(?mi)[^a-z0-9]`)
+
+	return rgx.ReplaceAllString(session, "")
+}
+
+// sessionFromData creates a session from stored session data, which is either JSON or PHP serialized. Without
+// auth.require_steam every existing session is accepted like before and the steam identifier is searched for in the
+// raw data if the session has no key for it.
+func sessionFromData(id string, data []byte) (*Session, error) {
+	var claims map[string]interface{}
+
+	err := json.Unmarshal(data, &claims)
+	if err != nil {
+		claims, err = phpSessionClaims(data)
+		if err != nil {
+			log.Debug("Failed to read session data of '" + id + "': " + err.Error())
+
+			if config.Auth.RequireSteam {
+				return nil, errInvalidSession
+			}
+		}
+	}
+
+	if steamFromClaims(claims) == "" {
+		if config.Auth.RequireSteam {
+			log.Debug("Rejected session '" + id + "' without a steam identifier")
+			return nil, errInvalidSession
+		}
+
+		rgx := regexp.MustCompile(`steam:[0-9a-fA-F]+`)
+		if steam := rgx.FindString(string(data)); steam != "" {
+			if claims == nil {
+				claims = make(map[string]interface{})
+			}
+
+			claims["steam"] = steam
+		}
+	}
+
+	return sessionFromClaims(id, claims), nil
+}
+
+func sessionFromClaims(id string, claims map[string]interface{}) *Session {
+	if claims == nil {
+		claims = make(map[string]interface{})
+	}
+
+	session := &Session{
+		ID:     id,
+		Claims: claims,
+	}
+
+	session.Steam = steamFromClaims(claims)
+	session.Name = nameFromClaims(claims)
+
+	session.Roles = rolesFromClaims(claims, session.Steam)
+	session.Permissions = resolvePermissions(session.Roles)
+
+	return session
+}
+
+func steamFromClaims(claims map[string]interface{}) string {
+	for _, key := range []string{"steam", "steamIdentifier", "steam_identifier"} {
+		if steam, ok := claims[key].(string); ok && steam != "" {
+			return steam
+		}
+	}
+
+	// The panel stores the logged in user, which carries the steam identifier of its player
+	for _, key := range []string{"user", "player"} {
+		if nested, ok := claims[key].(map[string]interface{}); ok {
+			if steam := steamFromClaims(nested); steam != "" {
+				return steam
+			}
+		}
+	}
+
+	return ""
+}
+
+func nameFromClaims(claims map[string]interface{}) string {
+	for _, key := range []string{"name", "playerName", "player_name"} {
+		if name, ok := claims[key].(string); ok && name != "" {
+			return name
+		}
+	}
+
+	for _, key := range []string{"user", "player"} {
+		if nested, ok := claims[key].(map[string]interface{}); ok {
+			if name := nameFromClaims(nested); name != "" {
+				return name
+			}
+		}
+	}
+
+	return ""
+}
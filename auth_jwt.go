@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// JWTAuthenticator validates HS256 signed tokens issued by the panel with a shared secret
+type JWTAuthenticator struct {
+	secret []byte
+}
+
+func newJWTAuthenticator(secret string) (*JWTAuthenticator, error) {
+	if len(secret) < 32 {
+		return nil, errors.New("the jwt secret has to be at least 32 characters long")
+	}
+
+	return &JWTAuthenticator{
+		secret: []byte(secret),
+	}, nil
+}
+
+func (a *JWTAuthenticator) Name() string {
+	return "jwt"
+}
+
+func (a *JWTAuthenticator) Authenticate(token, cluster string) (*Session, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidSession
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+	}
+	err := decodeJWTPart(parts[0], &header)
+	if err != nil || header.Algorithm != "HS256" {
+		log.Debug("Rejected jwt with invalid header")
+		return nil, errInvalidSession
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidSession
+	}
+
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		log.Debug("Rejected jwt with invalid signature")
+		return nil, errInvalidSession
+	}
+
+	var claims map[string]interface{}
+	err = decodeJWTPart(parts[1], &claims)
+	if err != nil {
+		return nil, errInvalidSession
+	}
+
+	now := float64(time.Now().Unix())
+
+	exp, ok := claims["exp"].(float64)
+	if !ok || now >= exp {
+		log.Debug("Rejected expired jwt")
+		return nil, errInvalidSession
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok && now < nbf {
+		return nil, errInvalidSession
+	}
+
+	if c, ok := claims["cluster"].(string); ok && c != cluster {
+		log.Debug("Rejected jwt for cluster '" + c + "' (expected '" + cluster + "')")
+		return nil, errInvalidSession
+	}
+
+	id, _ := claims["jti"].(string)
+	if id == "" {
+		id = parts[2]
+	}
+
+	// The subject is used as the steam identifier if the token has no steam claim, it also decides the granted role
+	if sub, ok := claims["sub"].(string); ok && steamFromClaims(claims) == "" {
+		claims["steam"] = sub
+	}
+
+	return sessionFromClaims(id, claims), nil
+}
+
+func decodeJWTPart(part string, dst interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, dst)
+}
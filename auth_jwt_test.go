@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+const testJWTSecret = "at-least-32-characters-long-shared-secret"
+
+func signTestJWT(t *testing.T, header, claims map[string]interface{}, secret string) string {
+	t.Helper()
+
+	encode := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	unsigned := encode(header) + "." + encode(claims)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unsigned))
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestJWTAuthenticate(t *testing.T) {
+	useTestConfig(t, "")
+
+	auth, err := newJWTAuthenticator(testJWTSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hs256 := map[string]interface{}{"alg": "HS256", "typ": "JWT"}
+	exp := time.Now().Add(time.Hour).Unix()
+
+	token := signTestJWT(t, hs256, map[string]interface{}{
+		"sub":     "steam:11000010a1b2c3d",
+		"name":    "Kiwi",
+		"role":    "senior",
+		"cluster": "c2",
+		"exp":     exp,
+		"jti":     "session-1",
+	}, testJWTSecret)
+
+	session, err := auth.Authenticate(token, "c2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if session.ID != "session-1" || session.Steam != "steam:11000010a1b2c3d" || session.Name != "Kiwi" || !session.Can(PermissionAudit) || session.Can(PermissionAdmin) {
+		t.Errorf("unexpected session %+v", session)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"bad signature", signTestJWT(t, hs256, map[string]interface{}{"sub": "steam:1", "exp": exp}, testJWTSecret+"-other")},
+		{"expired", signTestJWT(t, hs256, map[string]interface{}{"sub": "steam:1", "exp": time.Now().Add(-time.Minute).Unix()}, testJWTSecret)},
+		{"missing exp", signTestJWT(t, hs256, map[string]interface{}{"sub": "steam:1"}, testJWTSecret)},
+		{"string exp", signTestJWT(t, hs256, map[string]interface{}{"sub": "steam:1", "exp": "9999999999"}, testJWTSecret)},
+		{"not yet valid", signTestJWT(t, hs256, map[string]interface{}{"sub": "steam:1", "exp": exp, "nbf": exp}, testJWTSecret)},
+		{"other cluster", signTestJWT(t, hs256, map[string]interface{}{"sub": "steam:1", "exp": exp, "cluster": "c3"}, testJWTSecret)},
+		{"alg none", signTestJWT(t, map[string]interface{}{"alg": "none"}, map[string]interface{}{"sub": "steam:1", "exp": exp}, testJWTSecret)},
+		{"alg none unsigned", base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"steam:1","exp":9999999999}`)) + "."},
+		{"alg HS512", signTestJWT(t, map[string]interface{}{"alg": "HS512"}, map[string]interface{}{"sub": "steam:1", "exp": exp}, testJWTSecret)},
+		{"malformed", "not.a-jwt"},
+		{"invalid signature encoding", token[:len(token)-2] + "!!"},
+	}
+
+	for _, test := range tests {
+		_, err = auth.Authenticate(test.token, "c2")
+		if err != errInvalidSession {
+			t.Errorf("%s: expected an invalid session, got %v", test.name, err)
+		}
+	}
+
+	_, err = newJWTAuthenticator("too-short")
+	if err == nil {
+		t.Error("expected short secrets to be rejected")
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+)
+
+var errInvalidPHPData = errors.New("invalid php serialized data")
+
+// phpSessionClaims reads PHP session data, which is either a serialized array or in the session_encode format
+// (name|value name|value ...). Only the top level keys are returned, nothing is guessed from the raw data.
+func phpSessionClaims(data []byte) (map[string]interface{}, error) {
+	d := &phpDecoder{
+		data: bytes.TrimSpace(data),
+	}
+
+	if len(d.data) > 1 && (d.data[0] == 'a' || d.data[0] == 'O') && d.data[1] == ':' {
+		value, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+
+		claims, ok := value.(map[string]interface{})
+		if !ok || d.pos != len(d.data) {
+			return nil, errInvalidPHPData
+		}
+
+		return claims, nil
+	}
+
+	claims := make(map[string]interface{})
+
+	for d.pos < len(d.data) {
+		end := bytes.IndexByte(d.data[d.pos:], '|')
+		if end <= 0 {
+			return nil, errInvalidPHPData
+		}
+
+		name := string(d.data[d.pos : d.pos+end])
+		d.pos += end + 1
+
+		value, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+
+		claims[name] = value
+	}
+
+	return claims, nil
+}
+
+type phpDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *phpDecoder) value() (interface{}, error) {
+	if d.pos+1 >= len(d.data) {
+		return nil, errInvalidPHPData
+	}
+
+	typ := d.data[d.pos]
+
+	if typ == 'N' {
+		return nil, d.expect("N;")
+	}
+
+	if d.data[d.pos+1] != ':' {
+		return nil, errInvalidPHPData
+	}
+
+	d.pos += 2
+
+	switch typ {
+	case 'b':
+		value, err := d.until(';')
+		return value == "1", err
+	case 'i':
+		value, err := d.until(';')
+		if err != nil {
+			return nil, err
+		}
+
+		return strconv.ParseInt(value, 10, 64)
+	case 'd':
+		value, err := d.until(';')
+		if err != nil {
+			return nil, err
+		}
+
+		return strconv.ParseFloat(value, 64)
+	case 's':
+		value, err := d.string()
+		if err != nil {
+			return nil, err
+		}
+
+		return value, d.expect(";")
+	case 'a':
+		return d.array()
+	case 'O':
+		// Objects are read like arrays, the class name is dropped
+		_, err := d.string()
+		if err != nil {
+			return nil, err
+		}
+
+		err = d.expect(":")
+		if err != nil {
+			return nil, err
+		}
+
+		return d.array()
+	}
+
+	return nil, errors.New("unsupported php serialized type '" + string(typ) + "'")
+}
+
+// string reads a length prefixed string like 5:"steam"
+func (d *phpDecoder) string() (string, error) {
+	value, err := d.until(':')
+	if err != nil {
+		return "", err
+	}
+
+	length, err := strconv.Atoi(value)
+	if err != nil || length < 0 || d.pos+length+2 > len(d.data) || d.data[d.pos] != '"' || d.data[d.pos+length+1] != '"' {
+		return "", errInvalidPHPData
+	}
+
+	str := string(d.data[d.pos+1 : d.pos+length+1])
+	d.pos += length + 2
+
+	return str, nil
+}
+
+// array reads the entries of an array like 2:{...}, lists are returned as slices and everything else as maps
+func (d *phpDecoder) array() (interface{}, error) {
+	value, err := d.until(':')
+	if err != nil {
+		return nil, err
+	}
+
+	// Every entry takes up several bytes, larger counts can't be valid and must not be allocated
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 0 || count > len(d.data)-d.pos {
+		return nil, errInvalidPHPData
+	}
+
+	err = d.expect("{")
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]interface{}, count)
+	list := make([]interface{}, 0, count)
+
+	for i := 0; i < count; i++ {
+		key, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+
+		switch k := key.(type) {
+		case int64:
+			if list != nil && k == int64(i) {
+				list = append(list, value)
+			} else {
+				list = nil
+			}
+
+			entries[strconv.FormatInt(k, 10)] = value
+		case string:
+			list = nil
+			entries[k] = value
+		default:
+			return nil, errInvalidPHPData
+		}
+	}
+
+	err = d.expect("}")
+	if err != nil {
+		return nil, err
+	}
+
+	if list != nil && count > 0 {
+		return list, nil
+	}
+
+	return entries, nil
+}
+
+func (d *phpDecoder) until(delimiter byte) (string, error) {
+	end := bytes.IndexByte(d.data[d.pos:], delimiter)
+	if end == -1 {
+		return "", errInvalidPHPData
+	}
+
+	value := string(d.data[d.pos : d.pos+end])
+	d.pos += end + 1
+
+	return value, nil
+}
+
+func (d *phpDecoder) expect(token string) error {
+	if !bytes.HasPrefix(d.data[d.pos:], []byte(token)) {
+		return errInvalidPHPData
+	}
+
+	d.pos += len(token)
+
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPHPSessionClaims(t *testing.T) {
+	token := strings.Repeat("a", 40)
+
+	tests := []struct {
+		name   string
+		data   string
+		claims map[string]interface{}
+	}{
+		{
+			"laravel",
+			`a:4:{s:6:"_token";s:40:"` + token + `";s:9:"_previous";a:1:{s:3:"url";s:29:"https://panel.example.com/map";}s:6:"_flash";a:2:{s:3:"old";a:0:{}s:3:"new";a:0:{}}s:5:"steam";s:21:"steam:11000010a1b2c3d";}`,
+			map[string]interface{}{
+				"_token":    token,
+				"_previous": map[string]interface{}{"url": "https://panel.example.com/map"},
+				"_flash": map[string]interface{}{
+					"old": map[string]interface{}{},
+					"new": map[string]interface{}{},
+				},
+				"steam": "steam:11000010a1b2c3d",
+			},
+		},
+		{
+			"session_encode",
+			`steam|s:21:"steam:11000010a1b2c3d";roles|a:2:{i:0;s:5:"staff";i:1;s:6:"senior";}admin|b:1;level|i:-3;ratio|d:0.5;none|N;`,
+			map[string]interface{}{
+				"steam": "steam:11000010a1b2c3d",
+				"roles": []interface{}{"staff", "senior"},
+				"admin": true,
+				"level": int64(-3),
+				"ratio": 0.5,
+				"none":  nil,
+			},
+		},
+		{
+			"object",
+			`a:1:{s:4:"user";O:8:"stdClass":2:{s:16:"steam_identifier";s:21:"steam:11000010a1b2c3d";s:4:"name";s:4:"Ki;}";}}`,
+			map[string]interface{}{
+				"user": map[string]interface{}{
+					"steam_identifier": "steam:11000010a1b2c3d",
+					"name":             "Ki;}",
+				},
+			},
+		},
+		{
+			"unordered list",
+			`list|a:2:{i:1;s:1:"a";i:0;s:1:"b";}`,
+			map[string]interface{}{
+				"list": map[string]interface{}{"1": "a", "0": "b"},
+			},
+		},
+		{
+			"empty",
+			``,
+			map[string]interface{}{},
+		},
+	}
+
+	for _, test := range tests {
+		claims, err := phpSessionClaims([]byte(test.data))
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(claims, test.claims) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.claims, claims)
+		}
+	}
+}
+
+func TestPHPSessionClaimsInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"truncated string", `a:1:{s:5:"steam";s:21:"steam:1100`},
+		{"truncated array", `a:1:{s:5:"steam";`},
+		{"missing array end", `a:0:{`},
+		{"missing semicolon", `steam|s:21:"steam:11000010a1b2c3d"`},
+		{"missing value", `steam|`},
+		{"missing name", `|s:1:"a";`},
+		{"trailing data", `a:0:{}x`},
+		{"not an array", `a:1:{i:0;s:1:"a";}`},
+		{"wrong string length", `steam|s:5:"steam:11000010a1b2c3d";`},
+		{"negative string length", `steam|s:-1:"";`},
+		{"oversized string length", `steam|s:99999999999999999999:"";`},
+		{"oversized count", `a:99999999999999:{}`},
+		{"count beyond data", `a:1000000:{}`},
+		{"negative count", `a:-1:{}`},
+		{"invalid key", `a:1:{b:1;s:1:"a";}`},
+		{"unsupported type", `user|C:3:"Foo":0:{}`},
+		{"invalid integer", `level|i:abc;`},
+	}
+
+	for _, test := range tests {
+		claims, err := phpSessionClaims([]byte(test.data))
+		if err == nil {
+			t.Errorf("%s: expected an error, got %v", test.name, claims)
+		}
+	}
+}
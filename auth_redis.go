@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxRedisBulkLength is the largest value (in bytes) that is read, sessions are much smaller than that
+const maxRedisBulkLength = 1 << 20
+
+// RedisAuthenticator looks sessions up in a redis (or any RESP compatible) key-value store
+type RedisAuthenticator struct {
+	Address  string
+	Password string
+	Database int64
+	Prefix   string
+}
+
+func newRedisAuthenticator(cfg RedisConfig) (*RedisAuthenticator, error) {
+	if cfg.Address == "" {
+		return nil, errors.New("a redis address is required for the redis backend")
+	}
+
+	return &RedisAuthenticator{
+		Address:  cfg.Address,
+		Password: cfg.Password,
+		Database: cfg.Database,
+		Prefix:   cfg.Prefix,
+	}, nil
+}
+
+func (a *RedisAuthenticator) Name() string {
+	return "redis (" + a.Address + ")"
+}
+
+func (a *RedisAuthenticator) Authenticate(token, cluster string) (*Session, error) {
+	token = sanitizeSessionID(token)
+	if token == "" {
+		return nil, errInvalidSession
+	}
+
+	key := a.Prefix + cluster + token
+
+	value, err := a.get(key)
+	if err != nil {
+		log.Warning("Failed to query redis session store: " + err.Error())
+		return nil, errInvalidSession
+	}
+
+	if value == nil {
+		log.Debug("Unable to find redis session '" + key + "'")
+		return nil, errInvalidSession
+	}
+
+	return sessionFromData(cluster+token, value)
+}
+
+// get returns the value of the given key or nil if it does not exist
+func (a *RedisAuthenticator) get(key string) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", a.Address, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	reader := bufio.NewReader(conn)
+
+	if a.Password != "" {
+		_, err = redisCommand(conn, reader, "AUTH", a.Password)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if a.Database != 0 {
+		_, err = redisCommand(conn, reader, "SELECT", strconv.FormatInt(a.Database, 10))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return redisCommand(conn, reader, "GET", key)
+}
+
+func redisCommand(conn net.Conn, reader *bufio.Reader, args ...string) ([]byte, error) {
+	command := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		command += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	_, err := conn.Write([]byte(command))
+	if err != nil {
+		return nil, err
+	}
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+
+	if line == "" {
+		return nil, errors.New("empty redis response")
+	}
+
+	switch line[0] {
+	case '+', ':':
+		return []byte(line[1:]), nil
+	case '-':
+		return nil, errors.New("redis: " + line[1:])
+	case '$':
+		length, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			return nil, errors.New("invalid redis bulk length")
+		}
+
+		if length < 0 {
+			return nil, nil
+		}
+
+		if length > maxRedisBulkLength {
+			return nil, errors.New("redis bulk length " + line[1:] + " exceeds the limit")
+		}
+
+		b := make([]byte, length+2)
+		_, err = io.ReadFull(reader, b)
+		if err != nil {
+			return nil, err
+		}
+
+		return b[:length], nil
+	}
+
+	return nil, errors.New("unsupported redis response '" + line + "'")
+}
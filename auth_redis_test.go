@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRedis is a stand-in for a RESP server which answers every command with the reply of its handler
+type fakeRedis struct {
+	listener net.Listener
+	handler  func(args []string) string
+
+	mutex    sync.Mutex
+	commands [][]string
+}
+
+func newFakeRedis(t *testing.T, handler func(args []string) string) *fakeRedis {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &fakeRedis{
+		listener: listener,
+		handler:  handler,
+	}
+
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go r.serve(conn)
+		}
+	}()
+
+	return r
+}
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	reader := bufio.NewReader(conn)
+
+	for {
+		args, err := readRESPCommand(reader)
+		if err != nil {
+			return
+		}
+
+		r.mutex.Lock()
+		r.commands = append(r.commands, args)
+		r.mutex.Unlock()
+
+		_, err = conn.Write([]byte(r.handler(args)))
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (r *fakeRedis) Commands() [][]string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.commands
+}
+
+func readRESPCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, count)
+	for i := range args {
+		line, err = reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		length, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+
+		b := make([]byte, length+2)
+		_, err = io.ReadFull(reader, b)
+		if err != nil {
+			return nil, err
+		}
+
+		args[i] = string(b[:length])
+	}
+
+	return args, nil
+}
+
+func bulkString(s string) string {
+	return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"
+}
+
+// fakeRedisStore answers AUTH, SELECT and GET like a redis server with a password and a single database
+func fakeRedisStore(password string, database int, values map[string]string) func(args []string) string {
+	authenticated := password == ""
+
+	return func(args []string) string {
+		switch strings.ToUpper(args[0]) {
+		case "AUTH":
+			if len(args) != 2 || args[1] != password {
+				return "-WRONGPASS invalid username-password pair or user is disabled.\r\n"
+			}
+
+			authenticated = true
+			return "+OK\r\n"
+		case "SELECT":
+			if args[1] != strconv.Itoa(database) {
+				return "-ERR DB index is out of range\r\n"
+			}
+
+			return "+OK\r\n"
+		case "GET":
+			if !authenticated {
+				return "-NOAUTH Authentication required.\r\n"
+			}
+
+			value, ok := values[args[1]]
+			if !ok {
+				return "$-1\r\n"
+			}
+
+			return bulkString(value)
+		}
+
+		return "-ERR unknown command '" + args[0] + "'\r\n"
+	}
+}
+
+func TestRedisAuthenticate(t *testing.T) {
+	useTestConfig(t, "")
+
+	server := newFakeRedis(t, fakeRedisStore("secret", 2, map[string]string{
+		"sessions:c2abc": `{"steamIdentifier": "steam:11000010a1b2c3d", "name": "Kiwi", "roles": ["staff"]}`,
+	}))
+
+	auth, err := newRedisAuthenticator(RedisConfig{
+		Address:  server.listener.Addr().String(),
+		Password: "secret",
+		Database: 2,
+		Prefix:   "sessions:",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session, err := auth.Authenticate("a-b.c", "c2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if session.Steam != "steam:11000010a1b2c3d" || session.Name != "Kiwi" || !session.Can(PermissionHistory) || session.Can(PermissionAudit) {
+		t.Errorf("unexpected session %+v", session)
+	}
+
+	expected := [][]string{{"AUTH", "secret"}, {"SELECT", "2"}, {"GET", "sessions:c2abc"}}
+	if commands := server.Commands(); !reflect.DeepEqual(commands, expected) {
+		t.Errorf("expected commands %v, got %v", expected, commands)
+	}
+}
+
+func TestRedisReplies(t *testing.T) {
+	useTestConfig(t, "")
+
+	// Session data is binary safe, it may contain line breaks
+	php := "steam|s:21:\"steam:11000010a1b2c3d\";note|s:2:\"\r\n\";"
+
+	tests := []struct {
+		name     string
+		config   RedisConfig
+		handler  func(args []string) string
+		value    []byte
+		errorMsg string
+	}{
+		{"bulk", RedisConfig{}, fakeRedisStore("", 0, map[string]string{"key": php}), []byte(php), ""},
+		{"nil bulk", RedisConfig{}, fakeRedisStore("", 0, nil), nil, ""},
+		{"wrong password", RedisConfig{Password: "wrong"}, fakeRedisStore("secret", 0, nil), nil, "redis: WRONGPASS invalid username-password pair or user is disabled."},
+		{"missing password", RedisConfig{}, fakeRedisStore("secret", 0, nil), nil, "redis: NOAUTH Authentication required."},
+		{"invalid database", RedisConfig{Database: 16}, fakeRedisStore("", 0, nil), nil, "redis: ERR DB index is out of range"},
+		{"empty reply", RedisConfig{}, func([]string) string { return "\r\n" }, nil, "empty redis response"},
+		{"unsupported reply", RedisConfig{}, func([]string) string { return "*1\r\n" }, nil, "unsupported redis response '*1'"},
+		{"invalid bulk length", RedisConfig{}, func([]string) string { return "$abc\r\n" }, nil, "invalid redis bulk length"},
+		{"oversized bulk length", RedisConfig{}, func([]string) string { return "$9223372036854775807\r\n" }, nil, "redis bulk length 9223372036854775807 exceeds the limit"},
+		{"bulk length above the limit", RedisConfig{}, func([]string) string { return "$1048577\r\n" }, nil, "redis bulk length 1048577 exceeds the limit"},
+	}
+
+	for _, test := range tests {
+		server := newFakeRedis(t, test.handler)
+
+		test.config.Address = server.listener.Addr().String()
+
+		auth, err := newRedisAuthenticator(test.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		value, err := auth.get("key")
+		if test.errorMsg != "" {
+			if err == nil || err.Error() != test.errorMsg {
+				t.Errorf("%s: expected error %q, got %v", test.name, test.errorMsg, err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+		} else if !reflect.DeepEqual(value, test.value) {
+			t.Errorf("%s: expected %q, got %q", test.name, test.value, value)
+		}
+	}
+}
+
+func TestRedisRejectedSessions(t *testing.T) {
+	useTestConfig(t, `
+auth:
+  require_steam: true
+`)
+
+	server := newFakeRedis(t, fakeRedisStore("", 0, map[string]string{
+		"c2nosteam": `{"name": "Kiwi", "url": "/players/steam:11000010a1b2c3d"}`,
+		"c2invalid": `not a session`,
+	}))
+
+	auth, err := newRedisAuthenticator(RedisConfig{
+		Address: server.listener.Addr().String(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, token := range []string{"missing", "nosteam", "invalid", "---"} {
+		_, err = auth.Authenticate(token, "c2")
+		if err != errInvalidSession {
+			t.Errorf("%s: expected an invalid session, got %v", token, err)
+		}
+	}
+
+	// Unreachable stores never authenticate
+	_ = server.listener.Close()
+
+	_, err = auth.Authenticate("missing", "c2")
+	if err != errInvalidSession {
+		t.Errorf("expected an invalid session for an unreachable store, got %v", err)
+	}
+
+	_, err = newRedisAuthenticator(RedisConfig{})
+	if err == nil {
+		t.Error("expected an address to be required")
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+)
+
+// The session files in testdata/panel follow the panel's session_storage layout, the logged in user carries its player
+func TestFileAuthenticator(t *testing.T) {
+	useTestConfig(t, `
+auth:
+  roles:
+    "steam:11000010A1B2C3D": senior
+`)
+
+	auth, err := newFileAuthenticator("testdata/panel/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		token string
+		steam string
+		name  string
+		role  string
+	}{
+		{"k3l9x2m4n8p7q1", "steam:11000010a1b2c3d", "Kiwi", RoleSenior},
+		{"php00000000000001", "steam:110000112345678", "Ducky", RoleTrial},
+		// Sessions without a steam identifier key are still accepted unless auth.require_steam is set
+		{"legacy0000000001", "steam:11000010d4e5f60", "", RoleTrial},
+	}
+
+	for _, test := range tests {
+		session, err := auth.Authenticate(test.token, "c1")
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.token, err)
+			continue
+		}
+
+		if session.ID != "c1"+test.token || session.Steam != test.steam || session.Name != test.name || len(session.Roles) != 1 || session.Roles[0] != test.role {
+			t.Errorf("%s: unexpected session %+v", test.token, session)
+		}
+	}
+
+	for _, token := range []string{"unknown", "../panel/storage/framework/session_storage/c1k3l9x2m4n8p7q1", ""} {
+		_, err = auth.Authenticate(token, "c1")
+		if err != errInvalidSession {
+			t.Errorf("%q: expected an invalid session, got %v", token, err)
+		}
+	}
+
+	_, err = auth.Authenticate("k3l9x2m4n8p7q1", "c2")
+	if err != errInvalidSession {
+		t.Errorf("expected sessions to be bound to their cluster, got %v", err)
+	}
+}
+
+func TestRequireSteam(t *testing.T) {
+	useTestConfig(t, `
+auth:
+  require_steam: true
+`)
+
+	auth, err := newFileAuthenticator("testdata/panel")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, token := range []string{"k3l9x2m4n8p7q1", "php00000000000001"} {
+		_, err = auth.Authenticate(token, "c1")
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", token, err)
+		}
+	}
+
+	_, err = auth.Authenticate("legacy0000000001", "c1")
+	if err != errInvalidSession {
+		t.Errorf("expected a session without a steam identifier key to be rejected, got %v", err)
+	}
+
+	_, err = sessionFromData("c1invalid", []byte("not a session"))
+	if err != errInvalidSession {
+		t.Errorf("expected unreadable session data to be rejected, got %v", err)
+	}
+}
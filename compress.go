@@ -4,13 +4,16 @@ import (
 	"bytes"
 	"compress/gzip"
 	"fmt"
-	"time"
+	"sync"
 )
 
 type CCharacter struct {
 	Flags    int64  `json:"a,omitempty"`
 	FullName string `json:"b,omitempty"`
 	ID       int64  `json:"c,omitempty"`
+
+	// FlagNames is only sent to verbose clients
+	FlagNames []string `json:"d,omitempty"`
 }
 
 type CVehicle struct {
@@ -18,18 +21,28 @@ type CVehicle struct {
 	ID      int64  `json:"b,omitempty"`
 	Model   string `json:"c,omitempty"`
 	Name    string `json:"d,omitempty"`
+
+	Class       string `json:"e,omitempty"`
+	DisplayName string `json:"f,omitempty"`
+	Emergency   bool   `json:"g,omitempty"`
 }
 
 type CPlayer struct {
 	AFK            int64       `json:"a,omitempty"`
 	Character      *CCharacter `json:"b,omitempty"`
-	Movement       string      `json:"c,omitempty"`
+	Movement       string      `json:"c,omitempty" msgpack:"-"`
 	Flags          int64       `json:"d,omitempty"`
 	InvisibleSince int64       `json:"e,omitempty"`
 	Name           string      `json:"f,omitempty"`
 	Source         int64       `json:"g,omitempty"`
 	Steam          string      `json:"h,omitempty"`
 	Vehicle        *CVehicle   `json:"i,omitempty"`
+
+	// FlagNames is only sent to verbose clients
+	FlagNames []string `json:"j,omitempty"`
+
+	// Position replaces the movement string in binary frames (x, y, z, heading and speed if moving)
+	Position []float32 `json:"-" msgpack:"c,omitempty"`
 }
 
 type CDutyPlayer struct {
@@ -38,62 +51,62 @@ type CDutyPlayer struct {
 	SteamIdentifier string `json:"c,omitempty"`
 }
 
-func CompressPlayers(server string, players []map[string]interface{}) []CPlayer {
+func CompressPlayers(server string, players []Player) []CPlayer {
 	compressed := make([]CPlayer, len(players))
 
 	for i, p := range players {
-		character := getMap("character", p)
 		var c *CCharacter
-		if character != nil {
+		if p.Character != nil {
 			c = &CCharacter{
-				Flags:    getInt64("flags", character),
-				FullName: getString("fullName", character, false),
-				ID:       getInt64("id", character),
+				Flags:    p.Character.Flags,
+				FullName: p.Character.FullName,
+				ID:       p.Character.ID,
 			}
 		}
 
-		vehicle := getMap("vehicle", p)
 		var v *CVehicle
-		if vehicle != nil {
+		if p.Vehicle != nil {
 			v = &CVehicle{
-				Driving: getBool("driving", vehicle),
-				ID:      getInt64("id", vehicle),
-				Model:   getString("model", vehicle, true),
-				Name:    getString("name", vehicle, false),
+				Driving: p.Vehicle.Driving,
+				ID:      p.Vehicle.ID,
+				Model:   p.Vehicle.Model,
+				Name:    p.Vehicle.Name,
+
+				Class:       p.Vehicle.Metadata.Class,
+				DisplayName: p.Vehicle.Metadata.DisplayName,
+				Emergency:   p.Vehicle.Metadata.Emergency,
 			}
 		}
 
 		compressed[i] = CPlayer{
-			AFK:            0,
+			AFK:            updateAFK(server, p.SteamIdentifier, p.Coords),
 			Character:      c,
 			Movement:       getMovementData(p),
-			Flags:          getInt64("flags", p),
-			InvisibleSince: getInt64("invisible_since", p),
-			Name:           getString("name", p, false),
-			Source:         getInt64("source", p),
-			Steam:          getString("steamIdentifier", p, false),
+			Position:       getPosition(p),
+			Flags:          p.Flags,
+			InvisibleSince: p.InvisibleSince,
+			Name:           p.Name,
+			Source:         p.Source,
+			Steam:          p.SteamIdentifier,
 			Vehicle:        v,
 		}
+	}
 
-		hash := compressed[i].Movement
-		id := compressed[i].Steam
-		now := time.Now().Unix()
-
-		lastPositionMutex.Lock()
-		pos, ok := lastPosition[server][id]
-		if !ok || pos.Coords != hash {
-			pos := MovementLog{
-				Time:   now,
-				Coords: hash,
-			}
-			lastPosition[server][id] = pos
-		}
-		lastPositionMutex.Unlock()
+	return compressed
+}
 
-		compressed[i].AFK = now - pos.Time
+// CompressDuty keeps the legacy "p" (police) and "e" (ems) keys for old clients and adds every department under "a"
+func CompressDuty(list OnDutyList) map[string]interface{} {
+	all := make(map[string][]CDutyPlayer, len(list.Departments))
+	for department, players := range list.Departments {
+		all[department] = CompressDutyPlayers(players)
 	}
 
-	return compressed
+	return map[string]interface{}{
+		"p": CompressDutyPlayers(list.Get(DepartmentPolice)),
+		"e": CompressDutyPlayers(list.Get(DepartmentMedical)),
+		"a": all,
+	}
 }
 
 func CompressDutyPlayers(players []OnDutyPlayer) []CDutyPlayer {
@@ -110,136 +123,73 @@ func CompressDutyPlayers(players []OnDutyPlayer) []CDutyPlayer {
 	return compressed
 }
 
-func getMovementData(m map[string]interface{}) string {
-	c := getMap("coords", m)
-
-	if c != nil {
-		x, xOk := c["x"].(float64)
-		y, yOk := c["y"].(float64)
-		z, zOk := c["z"].(float64)
-
-		h := getFloat64("heading", m)
-		s := getFloat64("speed", m)
-
-		if xOk && yOk && zOk {
-			str := fmt.Sprintf("%.1f,%.1f,%.1f,%.1f", x, y, z, h)
-
-			if s != 0 {
-				str += fmt.Sprintf(",%.1f", s)
-			}
-
-			return str
-		} else {
-			log.Warning("Unable to read '" + fmt.Sprint(c) + "' (coords) as xyz")
-		}
+func getMovementData(p Player) string {
+	if p.Coords == nil {
+		return ""
 	}
 
-	return ""
-}
-
-func getFloat64(key string, m map[string]interface{}) float64 {
-	v, ok := m[key]
+	str := fmt.Sprintf("%.1f,%.1f,%.1f,%.1f", p.Coords.X, p.Coords.Y, p.Coords.Z, p.Heading)
 
-	if ok && v != nil {
-		f, ok := v.(float64)
-
-		if ok {
-			return f
-		} else {
-			log.Warning("Unable to read '" + fmt.Sprint(v) + "' (" + key + ") as float64")
-		}
+	if p.Speed != 0 {
+		str += fmt.Sprintf(",%.1f", p.Speed)
 	}
 
-	return 0
+	return str
 }
 
-func getInt64(key string, m map[string]interface{}) int64 {
-	v, ok := m[key]
-
-	if ok && v != nil {
-		i, ok := v.(int64)
-
-		if !ok {
-			f, ok2 := v.(float64)
-			if ok2 {
-				ok = true
-				i = int64(f)
-			}
-		}
-
-		if ok {
-			return i
-		} else {
-			log.Warning("Unable to read '" + fmt.Sprint(v) + "' (" + key + ") as int64")
-		}
+func getPosition(p Player) []float32 {
+	if p.Coords == nil {
+		return nil
 	}
 
-	return 0
-}
-
-func getString(key string, m map[string]interface{}, tryFloat bool) string {
-	v, ok := m[key]
-
-	if ok && v != nil {
-		s, ok := v.(string)
-
-		if ok {
-			return s
-		} else {
-			if tryFloat {
-				f, ok := v.(float64)
-				if ok {
-					s = fmt.Sprintf("%.0f", f)
+	position := []float32{float32(p.Coords.X), float32(p.Coords.Y), float32(p.Coords.Z), float32(p.Heading)}
 
-					return s
-				}
-			}
-
-			log.Warning("Unable to read '" + fmt.Sprint(v) + "' (" + key + ") as string")
-		}
+	if p.Speed != 0 {
+		position = append(position, float32(p.Speed))
 	}
 
-	return ""
+	return position
 }
 
-func getBool(key string, m map[string]interface{}) bool {
-	v, ok := m[key]
-
-	if ok && v != nil {
-		b, ok := v.(bool)
+// Payload is a message which is gzipped at most once, no matter how many connections it is sent to
+type Payload struct {
+	raw     []byte
+	gzipped []byte
+	once    sync.Once
+}
 
-		if ok {
-			return b
-		} else {
-			log.Warning("Unable to read '" + fmt.Sprint(v) + "' (" + key + ") as bool")
-		}
+func newPayload(raw []byte) *Payload {
+	return &Payload{
+		raw: raw,
 	}
-
-	return false
 }
 
-func getMap(key string, m map[string]interface{}) map[string]interface{} {
-	v, ok := m[key]
+// For returns the message for a connection, which is gzipped unless the connection uses permessage-deflate
+func (p *Payload) For(deflate bool) []byte {
+	if deflate {
+		return p.raw
+	}
 
-	if ok && v != nil {
-		m, ok := v.(map[string]interface{})
+	p.once.Do(func() {
+		p.gzipped = gzipBytes(p.raw)
+	})
 
-		if ok {
-			return m
-		} else {
-			_, ok = v.(bool)
-			if !ok {
-				log.Warning("Unable to read '" + fmt.Sprint(v) + "' (" + key + ") as map or bool")
-			}
-		}
-	}
+	return p.gzipped
+}
 
-	return nil
+var gzipWriters = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(nil)
+	},
 }
 
 func gzipBytes(b []byte) []byte {
 	var buf bytes.Buffer
-	w := gzip.NewWriter(&buf)
+
+	w := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(w)
+
+	w.Reset(&buf)
 
 	_, err := w.Write(b)
 	if err != nil {
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io/ioutil"
+	"strconv"
+	"testing"
+)
+
+// benchmarkPlayers returns a busy server, every third player is driving and every fifth is standing still
+func benchmarkPlayers(count int) []Player {
+	players := make([]Player, count)
+
+	for i := range players {
+		id := int64(i + 1)
+
+		player := Player{
+			Source:          id,
+			Name:            "Player " + strconv.Itoa(i),
+			SteamIdentifier: "steam:11000010" + strconv.FormatInt(0xa000000+id, 16),
+			Coords:          &Coords{X: -1037.52 + float64(i)*13.7, Y: -2737.81 + float64(i)*7.3, Z: 20.17 + float64(i%40)},
+			Heading:         float64(i*37%360) + 0.45,
+			Character:       &Character{ID: 4000 + id, FullName: "Character " + strconv.Itoa(i), Flags: id % 4},
+		}
+
+		if i%5 != 0 {
+			player.Speed = float64(i%60) + 0.3
+		}
+
+		if i%3 == 0 {
+			player.Vehicle = &Vehicle{
+				ID:      3000 + id,
+				Driving: i%2 == 0,
+				Model:   "polnspeedo",
+				Metadata: VehicleModel{
+					Model:       "polnspeedo",
+					DisplayName: "Police Speedo",
+					Class:       VehicleClassEmergency,
+					Emergency:   true,
+				},
+			}
+		}
+
+		players[i] = player
+	}
+
+	return players
+}
+
+// deflateBytes compresses like gorilla/websocket does for permessage-deflate connections (which default to BestSpeed)
+func deflateBytes(w *flate.Writer, b []byte) []byte {
+	var buf bytes.Buffer
+
+	w.Reset(&buf)
+
+	_, _ = w.Write(b)
+	_ = w.Flush()
+
+	return buf.Bytes()
+}
+
+// BenchmarkMapFrame encodes and compresses a map frame for a single connection. ns/op is the CPU time per frame,
+// MB/s is based on the uncompressed frame and wire-B/frame is what is actually sent.
+func BenchmarkMapFrame(b *testing.B) {
+	useTestConfig(b, "")
+
+	session := &Session{
+		Permissions: map[string]bool{
+			PermissionAudit: true,
+		},
+	}
+
+	for _, count := range []int{50, 200, 500} {
+		players := benchmarkPlayers(count)
+
+		for _, format := range []string{FormatJSON, FormatMsgpack} {
+			for _, deflate := range []bool{false, true} {
+				compression := "gzip"
+				if deflate {
+					compression = "deflate"
+				}
+
+				b.Run(strconv.Itoa(count)+"/"+format+"/"+compression, func(b *testing.B) {
+					conn := &Connection{
+						Session: session,
+						Format:  format,
+						Deflate: deflate,
+					}
+
+					w, _ := flate.NewWriter(nil, flate.BestSpeed)
+
+					var raw, wire int
+
+					b.ReportAllocs()
+					b.ResetTimer()
+
+					for i := 0; i < b.N; i++ {
+						frame := &MapFrame{
+							Players: CompressPlayers("c1s1", players),
+						}
+
+						payload := frame.For(conn)
+						message := payload.For(deflate)
+
+						if deflate {
+							message = deflateBytes(w, message)
+						}
+
+						raw = len(payload.raw)
+						wire = len(message)
+					}
+
+					b.SetBytes(int64(raw))
+					b.ReportMetric(float64(wire), "wire-B/frame")
+				})
+			}
+		}
+	}
+}
+
+func TestPayload(t *testing.T) {
+	useTestConfig(t, "")
+
+	frame := &MapFrame{
+		Players: CompressPlayers("c1s1", benchmarkPlayers(50)),
+	}
+
+	payload := frame.For(&Connection{Format: FormatJSON})
+
+	if message := payload.For(true); !bytes.Equal(message, payload.raw) {
+		t.Error("expected deflate connections to receive the raw frame")
+	}
+
+	gzipped := payload.For(false)
+	if len(gzipped) == 0 || len(gzipped) >= len(payload.raw) {
+		t.Fatalf("expected the frame to be compressed, got %d of %d bytes", len(gzipped), len(payload.raw))
+	}
+
+	// The frame is only compressed once, no matter how many connections receive it
+	if again := payload.For(false); &again[0] != &gzipped[0] {
+		t.Error("expected the gzipped frame to be reused")
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(gzipped))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(b, payload.raw) {
+		t.Error("expected the gzipped frame to decompress to the raw frame")
+	}
+}
@@ -0,0 +1,766 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/subosito/gotenv"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Config struct {
+	Listen       string `yaml:"listen"`
+	PanelRoot    string `yaml:"panel_root"`
+	VehiclesFile string `yaml:"vehicles_file"`
+
+	TLS TLSConfig `yaml:"tls"`
+
+	HistoryPath          string `yaml:"history_path"`
+	HistoryRetentionDays int64  `yaml:"history_retention_days"`
+
+	// AuditPath contains the access log, flag records and vehicle sessions, AFKPath the AFK sessions and CachePath the heatmaps
+	AuditPath    string `yaml:"audit_path"`
+	AFKPath      string `yaml:"afk_path"`
+	CachePath    string `yaml:"cache_path"`
+	AFKStateFile string `yaml:"afk_state_file"`
+
+	AllowedOrigins []string `yaml:"allowed_origins"`
+
+	// WebsocketCompression allows clients to negotiate permessage-deflate by connecting with ?compression=deflate
+	WebsocketCompression bool `yaml:"websocket_compression"`
+
+	Auth AuthConfig `yaml:"auth"`
+	AFK  AFKConfig  `yaml:"afk"`
+	OTT  OTTConfig  `yaml:"one_time_tokens"`
+
+	Retry RetryConfig `yaml:"retry"`
+	Flags FlagsConfig `yaml:"flags"`
+
+	Clusters map[string]*ClusterConfig `yaml:"clusters"`
+	Servers  map[string]*ServerConfig  `yaml:"servers"`
+}
+
+type TLSConfig struct {
+	Listen string `yaml:"listen"`
+	Cert   string `yaml:"cert"`
+	Key    string `yaml:"key"`
+
+	// Require refuses to start without a valid certificate instead of falling back to plain http
+	Require        bool          `yaml:"require"`
+	RedirectHTTP   bool          `yaml:"redirect_http"`
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+}
+
+type AuthConfig struct {
+	Backend     string              `yaml:"backend"`
+	DefaultRole string              `yaml:"default_role"`
+	Roles       map[string]string   `yaml:"roles"`
+	Permissions map[string][]string `yaml:"permissions"`
+
+	// RequireSteam rejects sessions without a steam identifier key instead of searching the session data for one
+	RequireSteam bool        `yaml:"require_steam"`
+	JWTSecret    string      `yaml:"jwt_secret"`
+	Redis        RedisConfig `yaml:"redis"`
+}
+
+type RedisConfig struct {
+	Address  string `yaml:"address"`
+	Password string `yaml:"password"`
+	Database int64  `yaml:"database"`
+	Prefix   string `yaml:"prefix"`
+}
+
+type AFKConfig struct {
+	Tolerance float64       `yaml:"tolerance"`
+	Threshold time.Duration `yaml:"threshold"`
+}
+
+type OTTConfig struct {
+	RateLimit int  `yaml:"rate_limit"`
+	BindIP    bool `yaml:"bind_ip"`
+}
+
+// FlagsConfig adds flags to (or moves flags in) the user and character bit-fields, e.g. character: {cuffed: 4}
+type FlagsConfig struct {
+	User      FlagRegistry `yaml:"user"`
+	Character FlagRegistry `yaml:"character"`
+}
+
+// RetryConfig is the backoff policy shared by all upstream requests
+type RetryConfig struct {
+	Base time.Duration `yaml:"base"`
+	Max  time.Duration `yaml:"max"`
+
+	// Threshold is the number of consecutive failures after which the circuit breaker opens and requests back off
+	Threshold int `yaml:"threshold"`
+}
+
+type ClusterConfig struct {
+	Origins []string `yaml:"origins"`
+}
+
+type ServerConfig struct {
+	Token   string `yaml:"token"`
+	URL     string `yaml:"url"`
+	Adapter string `yaml:"adapter"`
+
+	// Mode is either poll (default) or push, in which case the game server sends its data to /ingest
+	Mode        string        `yaml:"mode"`
+	PushTimeout time.Duration `yaml:"push_timeout"`
+
+	TLSVerify *bool         `yaml:"tls_verify"`
+	Timeout   time.Duration `yaml:"timeout"`
+
+	// HTTP2 allows negotiating http/2 with https upstreams
+	HTTP2 bool `yaml:"http2"`
+
+	// The world state is polled every data_interval_min while someone has the map open and slows down to data_interval_max otherwise
+	DataIntervalMin time.Duration `yaml:"data_interval_min"`
+	DataIntervalMax time.Duration `yaml:"data_interval_max"`
+
+	DutyInterval          time.Duration `yaml:"duty_interval"`
+	StaffChatInterval     time.Duration `yaml:"staff_chat_interval"`
+	StaffChatIdleInterval time.Duration `yaml:"staff_chat_idle_interval"`
+
+	// Mapping is only used by the json adapter
+	Mapping *MappingConfig `yaml:"mapping"`
+
+	client     *http.Client
+	clientOnce sync.Once
+}
+
+var config *Config
+
+// loadConfig reads the config file if it exists and falls back to the legacy .env otherwise
+func loadConfig(file string) (*Config, error) {
+	cfg := &Config{}
+
+	b, err := ioutil.ReadFile(file)
+	if err == nil {
+		err = yaml.UnmarshalStrict(b, cfg)
+		if err != nil {
+			return nil, errors.New("failed to parse " + file + ": " + err.Error())
+		}
+	} else if os.IsNotExist(err) {
+		cfg, err = configFromEnv(".env")
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, err
+	}
+
+	cfg.applyDefaults()
+
+	err = cfg.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// configFromEnv builds the config from the legacy .env keys (cNsN, cNsN_speed, cNsN_map, PanelRoot, ...)
+func configFromEnv(file string) (*Config, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.New("failed to load " + file)
+	}
+
+	env := gotenv.Parse(bytes.NewReader(b))
+	for key, value := range env {
+		if _, ok := os.LookupEnv(key); !ok {
+			_ = os.Setenv(key, value)
+		}
+	}
+
+	cfg := &Config{
+		PanelRoot:      os.Getenv("PanelRoot"),
+		AllowedOrigins: parseOrigins(os.Getenv("ALLOWED_ORIGINS")),
+
+		HistoryPath:  os.Getenv("HISTORY_PATH"),
+		AuditPath:    os.Getenv("AUDIT_PATH"),
+		AFKPath:      os.Getenv("AFK_PATH"),
+		CachePath:    os.Getenv("CACHE_PATH"),
+		AFKStateFile: os.Getenv("AFK_STATE_FILE"),
+
+		WebsocketCompression: os.Getenv("WEBSOCKET_COMPRESSION") == "true",
+		Auth: AuthConfig{
+			Backend:      os.Getenv("AUTH_BACKEND"),
+			DefaultRole:  os.Getenv("AUTH_DEFAULT_ROLE"),
+			Roles:        parseRoles(os.Getenv("AUTH_ROLES")),
+			RequireSteam: os.Getenv("AUTH_REQUIRE_STEAM") == "true",
+			Permissions:  make(map[string][]string),
+			JWTSecret:    os.Getenv("AUTH_JWT_SECRET"),
+			Redis: RedisConfig{
+				Address:  os.Getenv("AUTH_REDIS_ADDR"),
+				Password: os.Getenv("AUTH_REDIS_PASSWORD"),
+				Prefix:   os.Getenv("AUTH_REDIS_PREFIX"),
+			},
+		},
+		OTT: OTTConfig{
+			BindIP: os.Getenv("OTT_BIND_IP") == "true",
+		},
+		Flags: FlagsConfig{
+			User:      make(FlagRegistry),
+			Character: make(FlagRegistry),
+		},
+		Clusters: make(map[string]*ClusterConfig),
+		Servers:  make(map[string]*ServerConfig),
+	}
+
+	var problems []string
+	parse := func(key string, parser func(string) error) {
+		value := os.Getenv(key)
+		if value == "" {
+			return
+		}
+
+		if err := parser(value); err != nil {
+			problems = append(problems, "invalid "+key+" '"+value+"'")
+		}
+	}
+
+	// Previously TLS and the non-TLS fallback were both served on :9999
+	if os.Getenv("SSL_CERT") != "" || os.Getenv("SSL_KEY") != "" {
+		cfg.TLS = TLSConfig{
+			Listen: ":9999",
+			Cert:   os.Getenv("SSL_CERT"),
+			Key:    os.Getenv("SSL_KEY"),
+		}
+	}
+
+	parse("AUTH_REDIS_DB", func(v string) (err error) {
+		cfg.Auth.Redis.Database, err = strconv.ParseInt(v, 10, 64)
+		return
+	})
+	parse("AFK_TOLERANCE", func(v string) (err error) {
+		cfg.AFK.Tolerance, err = strconv.ParseFloat(v, 64)
+		return
+	})
+	parse("AFK_THRESHOLD", func(v string) error {
+		seconds, err := strconv.ParseInt(v, 10, 64)
+		cfg.AFK.Threshold = time.Duration(seconds) * time.Second
+		return err
+	})
+	parse("OTT_RATE_LIMIT", func(v string) (err error) {
+		cfg.OTT.RateLimit, err = strconv.Atoi(v)
+		return
+	})
+	parse("RETRY_BASE", func(v string) error {
+		seconds, err := strconv.ParseInt(v, 10, 64)
+		cfg.Retry.Base = time.Duration(seconds) * time.Second
+		return err
+	})
+	parse("RETRY_MAX", func(v string) error {
+		seconds, err := strconv.ParseInt(v, 10, 64)
+		cfg.Retry.Max = time.Duration(seconds) * time.Second
+		return err
+	})
+	parse("RETRY_THRESHOLD", func(v string) (err error) {
+		cfg.Retry.Threshold, err = strconv.Atoi(v)
+		return
+	})
+
+	serverRgx := regexp.MustCompile(`(?m)^c\d+s\d+$`)
+	for key := range env {
+		value := os.Getenv(key)
+
+		switch {
+		case serverRgx.MatchString(key) && value != "":
+			s := serverConfigFromEnv(key, value)
+
+			parse(key+"_interval_min", func(v string) error {
+				seconds, err := strconv.ParseFloat(v, 64)
+				s.DataIntervalMin = time.Duration(seconds * float64(time.Second))
+				return err
+			})
+			parse(key+"_interval_max", func(v string) error {
+				seconds, err := strconv.ParseFloat(v, 64)
+				s.DataIntervalMax = time.Duration(seconds * float64(time.Second))
+				return err
+			})
+
+			cfg.Servers[key] = s
+		case strings.HasPrefix(key, "FLAG_USER_"), strings.HasPrefix(key, "FLAG_CHARACTER_"):
+			parse(key, func(v string) error {
+				bit, err := strconv.ParseUint(v, 10, 8)
+
+				name := strings.ToLower(strings.TrimPrefix(strings.TrimPrefix(key, "FLAG_USER_"), "FLAG_CHARACTER_"))
+				if strings.HasPrefix(key, "FLAG_USER_") {
+					cfg.Flags.User[name] = uint(bit)
+				} else {
+					cfg.Flags.Character[name] = uint(bit)
+				}
+
+				return err
+			})
+		case strings.HasPrefix(key, "PERMISSIONS_"):
+			role := strings.ToLower(strings.TrimPrefix(key, "PERMISSIONS_"))
+			cfg.Auth.Permissions[role] = strings.Split(value, ",")
+		case strings.HasSuffix(key, "_origins"):
+			cfg.Clusters[strings.TrimSuffix(key, "_origins")] = &ClusterConfig{
+				Origins: parseOrigins(value),
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return nil, errors.New(strings.Join(problems, ", "))
+	}
+
+	return cfg, nil
+}
+
+// mergeFlags adds the configured flags to the default flags
+func mergeFlags(defaults, configured FlagRegistry) FlagRegistry {
+	merged := make(FlagRegistry, len(defaults)+len(configured))
+
+	for name, bit := range defaults {
+		merged[name] = bit
+	}
+
+	for name, bit := range configured {
+		merged[name] = bit
+	}
+
+	return merged
+}
+
+func serverConfigFromEnv(server, token string) *ServerConfig {
+	s := &ServerConfig{
+		Token: token,
+	}
+
+	if os.Getenv(server+"_speed") == "slow" {
+		s.Timeout = 15 * time.Second
+		s.DataIntervalMin = 5 * time.Second
+		s.DutyInterval = 30 * time.Second
+		s.StaffChatInterval = 10 * time.Second
+		s.StaffChatIdleInterval = 20 * time.Second
+	}
+
+	s.Mode = os.Getenv(server + "_mode")
+	s.HTTP2 = os.Getenv(server+"_http2") == "true"
+
+	override := os.Getenv(server + "_map")
+	if override != "" {
+		verify := false
+
+		s.URL = "http://" + override
+		s.TLSVerify = &verify
+	}
+
+	return s
+}
+
+func (c *Config) applyDefaults() {
+	if c.TLS.Enabled() {
+		if c.TLS.Listen == "" {
+			c.TLS.Listen = ":9443"
+
+			if c.Listen == "" {
+				c.TLS.Listen = ":9999"
+			}
+		}
+
+		if c.TLS.ReloadInterval == 0 {
+			c.TLS.ReloadInterval = 1 * time.Minute
+		}
+	} else if c.Listen == "" {
+		c.Listen = ":9999"
+	}
+
+	if c.VehiclesFile == "" {
+		c.VehiclesFile = "vehicles.json"
+	}
+
+	if c.HistoryPath == "" {
+		c.HistoryPath = "./history"
+	}
+	c.HistoryPath = strings.TrimRight(c.HistoryPath, "/")
+
+	if c.AuditPath == "" {
+		c.AuditPath = "./audit"
+	}
+	c.AuditPath = strings.TrimRight(c.AuditPath, "/")
+
+	if c.AFKPath == "" {
+		c.AFKPath = "./afk"
+	}
+	c.AFKPath = strings.TrimRight(c.AFKPath, "/")
+
+	if c.CachePath == "" {
+		c.CachePath = "./cache"
+	}
+	c.CachePath = strings.TrimRight(c.CachePath, "/")
+
+	if c.AFKStateFile == "" {
+		c.AFKStateFile = "afk.json"
+	}
+
+	if c.HistoryRetentionDays == 0 {
+		c.HistoryRetentionDays = 10
+	}
+
+	if c.Auth.Backend == "" {
+		c.Auth.Backend = "file"
+	}
+	c.Auth.Backend = strings.ToLower(c.Auth.Backend)
+
+	// Sessions without a role only get the least privileged role, higher roles have to be granted in auth.roles
+	if c.Auth.DefaultRole == "" {
+		c.Auth.DefaultRole = RoleTrial
+	}
+	c.Auth.DefaultRole = strings.ToLower(c.Auth.DefaultRole)
+
+	roles := make(map[string]string, len(c.Auth.Roles))
+	for steam, role := range c.Auth.Roles {
+		roles[strings.ToLower(steam)] = strings.ToLower(role)
+	}
+	c.Auth.Roles = roles
+
+	if c.AFK.Tolerance == 0 {
+		c.AFK.Tolerance = 1.5
+	}
+
+	if c.AFK.Threshold == 0 {
+		c.AFK.Threshold = 5 * time.Minute
+	}
+
+	if c.OTT.RateLimit == 0 {
+		c.OTT.RateLimit = 10
+	}
+
+	c.Flags.User = mergeFlags(defaultUserFlags, c.Flags.User)
+	c.Flags.Character = mergeFlags(defaultCharacterFlags, c.Flags.Character)
+
+	if c.Retry.Base == 0 {
+		c.Retry.Base = 5 * time.Second
+	}
+
+	if c.Retry.Max == 0 {
+		c.Retry.Max = 15 * time.Minute
+	}
+
+	if c.Retry.Threshold == 0 {
+		c.Retry.Threshold = 3
+	}
+
+	if c.Clusters == nil {
+		c.Clusters = make(map[string]*ClusterConfig)
+	}
+
+	for name, s := range c.Servers {
+		if s == nil {
+			continue
+		}
+
+		if s.Adapter == "" {
+			s.Adapter = AdapterOPFramework
+		}
+
+		if s.Mode == "" {
+			s.Mode = ModePoll
+		}
+
+		if s.PushTimeout == 0 {
+			s.PushTimeout = 30 * time.Second
+		}
+
+		if s.URL == "" && s.Adapter == AdapterOPFramework {
+			s.URL = "http://" + name + ".op-framework.com"
+		}
+		s.URL = strings.TrimRight(s.URL, "/")
+
+		if s.TLSVerify == nil {
+			verify := true
+			s.TLSVerify = &verify
+		}
+
+		if s.Timeout == 0 {
+			s.Timeout = 10 * time.Second
+		}
+
+		if s.DataIntervalMin == 0 {
+			s.DataIntervalMin = 1 * time.Second
+		}
+
+		if s.DataIntervalMax == 0 {
+			s.DataIntervalMax = 10 * time.Second
+
+			if s.DataIntervalMin > s.DataIntervalMax {
+				s.DataIntervalMax = s.DataIntervalMin
+			}
+		}
+
+		if s.DutyInterval == 0 {
+			s.DutyInterval = 15 * time.Second
+		}
+
+		if s.StaffChatInterval == 0 {
+			s.StaffChatInterval = 2 * time.Second
+		}
+
+		if s.StaffChatIdleInterval == 0 {
+			s.StaffChatIdleInterval = 5 * time.Second
+		}
+	}
+}
+
+func (c *Config) validate() error {
+	var problems []string
+
+	switch c.Auth.Backend {
+	case "file":
+		if c.PanelRoot == "" {
+			problems = append(problems, "panel_root is required for the file auth backend")
+		}
+	case "redis":
+		if c.Auth.Redis.Address == "" {
+			problems = append(problems, "auth.redis.address is required for the redis auth backend")
+		}
+	case "jwt":
+		if len(c.Auth.JWTSecret) < 32 {
+			problems = append(problems, "auth.jwt_secret has to be at least 32 characters long")
+		}
+	default:
+		problems = append(problems, "unknown auth.backend '"+c.Auth.Backend+"'")
+	}
+
+	knownRole := func(role string) bool {
+		_, ok := defaultRolePermissions[role]
+		if !ok {
+			_, ok = c.Auth.Permissions[role]
+		}
+
+		return ok
+	}
+
+	if !knownRole(c.Auth.DefaultRole) {
+		problems = append(problems, "auth.default_role '"+c.Auth.DefaultRole+"' is unknown")
+	}
+
+	for steam, role := range c.Auth.Roles {
+		if !strings.HasPrefix(steam, "steam:") {
+			problems = append(problems, "auth.roles key '"+steam+"' is not a steam identifier")
+		}
+
+		if !knownRole(role) {
+			problems = append(problems, "auth.roles."+steam+" role '"+role+"' is unknown")
+		}
+	}
+
+	if c.TLS.Enabled() {
+		if c.TLS.Cert == "" || c.TLS.Key == "" {
+			problems = append(problems, "tls.cert and tls.key are both required for tls")
+		}
+
+		if c.TLS.Listen == c.Listen {
+			problems = append(problems, "listen and tls.listen can't be the same address")
+		}
+
+		if c.TLS.ReloadInterval < 0 {
+			problems = append(problems, "tls.reload_interval can't be negative")
+		}
+	} else if c.TLS.Require || c.TLS.RedirectHTTP {
+		problems = append(problems, "tls.require and tls.redirect_http need tls.cert and tls.key")
+	}
+
+	paths := map[string]string{
+		"history_path": c.HistoryPath,
+		"audit_path":   c.AuditPath,
+		"afk_path":     c.AFKPath,
+		"cache_path":   c.CachePath,
+	}
+
+	for key, path := range paths {
+		if stat, err := os.Stat(path); err == nil && !stat.IsDir() {
+			problems = append(problems, key+" '"+path+"' is not a directory")
+		}
+
+		// The history cleanup removes old day directories, so nothing else may be stored inside another path
+		for other, otherPath := range paths {
+			if key != other && (filepath.Clean(path) == filepath.Clean(otherPath) || strings.HasPrefix(filepath.Clean(path), filepath.Clean(otherPath)+string(filepath.Separator))) {
+				problems = append(problems, key+" can't be "+other+" or inside it")
+			}
+		}
+	}
+
+	if stat, err := os.Stat(c.AFKStateFile); err == nil && stat.IsDir() {
+		problems = append(problems, "afk_state_file '"+c.AFKStateFile+"' is a directory")
+	}
+
+	if c.HistoryRetentionDays < 0 {
+		problems = append(problems, "history_retention_days can't be negative")
+	}
+
+	if c.AFK.Tolerance < 0 || c.AFK.Threshold < 0 {
+		problems = append(problems, "afk.tolerance and afk.threshold can't be negative")
+	}
+
+	if c.OTT.RateLimit < 0 {
+		problems = append(problems, "one_time_tokens.rate_limit can't be negative")
+	}
+
+	if c.Retry.Base < 0 || c.Retry.Max < c.Retry.Base || c.Retry.Threshold < 0 {
+		problems = append(problems, "retry.base and retry.threshold can't be negative and retry.max can't be lower than retry.base")
+	}
+
+	names := make(map[string]string)
+	for typ, registry := range map[string]FlagRegistry{"user": c.Flags.User, "character": c.Flags.Character} {
+		bits := make(map[uint]string)
+
+		for name, bit := range registry {
+			if bit > 62 {
+				problems = append(problems, fmt.Sprintf("flags.%s.%s has to be a bit between 0 and 62", typ, name))
+			}
+
+			if other, ok := bits[bit]; ok {
+				problems = append(problems, fmt.Sprintf("flags.%s.%s and flags.%s.%s use the same bit", typ, name, typ, other))
+			}
+			bits[bit] = name
+
+			// Flag records are stored by name, so user and character flags can't share one
+			if other, ok := names[name]; ok && other != typ {
+				problems = append(problems, "flag '"+name+"' is defined for users and characters")
+			}
+			names[name] = typ
+		}
+	}
+
+	if len(c.Servers) == 0 {
+		problems = append(problems, "no servers configured")
+	}
+
+	serverRgx := regexp.MustCompile(`(?m)^c\d+s\d+$`)
+	for _, name := range c.ServerNames() {
+		s := c.Servers[name]
+
+		if !serverRgx.MatchString(name) {
+			problems = append(problems, "server '"+name+"' does not match cNsN")
+		}
+
+		if s == nil || s.Token == "" {
+			problems = append(problems, "servers."+name+".token is required")
+			continue
+		}
+
+		switch s.Adapter {
+		case AdapterOPFramework:
+		case AdapterJSON:
+			if s.Mapping == nil || s.Mapping.Players.Path == "" {
+				problems = append(problems, "servers."+name+".mapping.players.path is required for the json adapter")
+			}
+		default:
+			problems = append(problems, "servers."+name+".adapter '"+s.Adapter+"' is unknown")
+		}
+
+		if s.Mode != ModePoll && s.Mode != ModePush {
+			problems = append(problems, "servers."+name+".mode has to be poll or push")
+		}
+
+		// Pushing servers don't need to be reachable
+		u, err := url.Parse(s.URL)
+		if s.Mode == ModePoll && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+			problems = append(problems, "servers."+name+".url '"+s.URL+"' is not a valid http(s) url")
+		}
+
+		for key, d := range map[string]time.Duration{
+			"timeout":                  s.Timeout,
+			"data_interval_min":        s.DataIntervalMin,
+			"data_interval_max":        s.DataIntervalMax,
+			"duty_interval":            s.DutyInterval,
+			"staff_chat_interval":      s.StaffChatInterval,
+			"staff_chat_idle_interval": s.StaffChatIdleInterval,
+			"push_timeout":             s.PushTimeout,
+		} {
+			if d < 0 {
+				problems = append(problems, fmt.Sprintf("servers.%s.%s can't be negative", name, key))
+			}
+		}
+
+		if s.DataIntervalMin > s.DataIntervalMax {
+			problems = append(problems, "servers."+name+".data_interval_min can't be higher than data_interval_max")
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+
+		return errors.New("invalid configuration:\n - " + strings.Join(problems, "\n - "))
+	}
+
+	return nil
+}
+
+func (t TLSConfig) Enabled() bool {
+	return t.Cert != "" || t.Key != ""
+}
+
+// ServerNames returns the names of all configured servers in a stable order
+func (c *Config) ServerNames() []string {
+	names := make([]string, 0, len(c.Servers))
+	for name := range c.Servers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func getServerConfig(server string) (*ServerConfig, bool) {
+	s, ok := config.Servers[server]
+
+	return s, ok && s != nil
+}
+
+// Endpoint returns the full upstream url for the given path (e.g. /op-framework/world.json)
+func (s *ServerConfig) Endpoint(path string) string {
+	return s.URL + path
+}
+
+// Client returns the http client of the server, which is shared by all requests so connections are kept alive
+func (s *ServerConfig) Client() *http.Client {
+	s.clientOnce.Do(func() {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+
+		// All loops of a server may request it at the same time
+		transport.MaxIdleConnsPerHost = 4
+		transport.IdleConnTimeout = 90 * time.Second
+
+		// Responses are requested and transparently decompressed as gzip
+		transport.DisableCompression = false
+
+		transport.ForceAttemptHTTP2 = s.HTTP2
+		if !s.HTTP2 {
+			transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+		}
+
+		if s.TLSVerify != nil && !*s.TLSVerify {
+			transport.TLSClientConfig = &tls.Config{
+				InsecureSkipVerify: true,
+			}
+		}
+
+		s.client = &http.Client{
+			Timeout:   s.Timeout,
+			Transport: transport,
+		}
+	})
+
+	return s.client
+}
@@ -1,244 +1,204 @@
 package main
 
 import (
-	"bytes"
-	"crypto/tls"
 	"encoding/json"
 	"fmt"
-	"github.com/subosito/gotenv"
-	"io/ioutil"
-	"net"
 	"net/http"
-	"os"
-	"regexp"
-	"strings"
+	"strconv"
 	"sync"
 	"time"
 )
 
-type Data struct {
-	Players []map[string]interface{}
-}
-
-type MovementLog struct {
-	Time   int64
-	Coords string
-}
-
 var (
 	lastError      = make(map[string]*time.Time)
 	lastErrorMutex sync.Mutex
 
-	lastPosition      = make(map[string]map[string]MovementLog)
-	lastPositionSave  = time.Unix(0, 0)
-	lastPositionMutex sync.Mutex
-
-	lastInvisible      = make(map[string]map[string]int64)
-	lastInvisibleMutex sync.Mutex
-
 	lastDuty      = make(map[string]OnDutyList)
 	lastDutyMutex sync.Mutex
 
-	loggedHashes      = make(map[string]bool)
-	loggedHashesMutex sync.Mutex
+	dataWakeups      = make(map[string]chan struct{})
+	dataWakeupsMutex sync.Mutex
 )
 
+// MapFrame is a single map update, which is filtered depending on the permissions of each viewer
+type MapFrame struct {
+	Players []CPlayer
+	Duty    map[string]interface{}
+	Viewers []string
+	AFK     []AFKEvent
+	Flags   []FlagEvent
+
+	cache map[string]*Payload
+}
+
 type InfoPackage struct {
 	Message string `json:"message"`
 	Status  int    `json:"status"`
+
+	// Breaker is only set for failed upstream requests
+	Breaker *BreakerState `json:"breaker,omitempty"`
 }
 
 func startDataLoop() {
-	b, _ := ioutil.ReadFile(".env")
-	env := gotenv.Parse(bytes.NewReader(b))
-
-	servers := make([]string, 0)
-	for server := range env {
-		rgx := regexp.MustCompile(`(?m)^c\d+s\d+$`)
-		if rgx.MatchString(server) && os.Getenv(server) != "" {
-			servers = append(servers, server)
+	for _, s := range config.ServerNames() {
+		cfg, _ := getServerConfig(s)
+
+		// Pushed data is processed as it arrives, we only have to notice when it stops
+		if cfg.Mode == ModePush {
+			go watchPushedData(s)
+			continue
 		}
-	}
 
-	for _, s := range servers {
 		go func(server string) {
-			for {
-				data, timeout, info := getData(server)
-
-				extraData(server, data)
-
-				var b []byte
-				if data == nil {
-					now := time.Now()
-
-					lastErrorMutex.Lock()
-					if lastError[server] == nil || now.Sub(*lastError[server]) > 30*time.Minute {
-						log.Warning("Failed to load data from " + server)
-						lastError[server] = &now
-					}
-					lastErrorMutex.Unlock()
-
-					if info != nil {
-						b, _ = json.Marshal(info)
-
-						serverErrorsMutex.Lock()
-						serverErrors[server] = b
-						serverErrorsMutex.Unlock()
-					} else {
-						b, _ = json.Marshal(nil)
-					}
-				} else {
-					lastDutyMutex.Lock()
-					last, ok := lastDuty[server]
-					lastDutyMutex.Unlock()
-
-					if !ok {
-						last.Police = []OnDutyPlayer{}
-						last.EMS = []OnDutyPlayer{}
-					}
-
-					b, _ = json.Marshal(map[string]interface{}{
-						"p": CompressPlayers(server, data.Players),
-						"d": map[string][]CDutyPlayer{
-							"p": CompressDutyPlayers(last.Police),
-							"e": CompressDutyPlayers(last.EMS),
-						},
-						"s": getSteamIdentifiersByTypeAndServer(SocketTypeMap, server),
-					})
-
-					serverErrorsMutex.Lock()
-					serverErrors[server] = nil
-					serverErrorsMutex.Unlock()
-				}
+			breaker := getBreaker(server, EndpointWorld)
+			wakeup := dataWakeup(server)
 
-				broadcastToSocket(server, gzipBytes(b), SocketTypeMap)
+			interval := cfg.DataIntervalMin
+			for {
+				data, info := upstreams[server].FetchPlayers()
 
-				if timeout != nil {
-					log.Debug(server + " - sleeping for " + timeout.String())
-					time.Sleep(*timeout)
-				}
+				processData(server, data, info)
 
-				isSlow := os.Getenv(server+"_speed") == "slow"
+				interval = nextDataInterval(cfg, interval, hasSocketConnections(server, SocketTypeMap))
 
-				if isSlow {
-					time.Sleep(5 * time.Second)
-				} else {
-					time.Sleep(1 * time.Second)
+				select {
+				case <-time.After(breaker.Delay(interval)):
+				case <-wakeup:
 				}
 			}
 		}(s)
 	}
 }
 
-func getData(server string) (*Data, *time.Duration, *InfoPackage) {
-	token := os.Getenv(server)
-	if token == "" {
-		log.Error(server + " - No token defined")
-		return nil, nil, &InfoPackage{"Missing token", http.StatusNotImplemented}
+// nextDataInterval polls at the minimum interval while the map is open and doubles it up to the maximum once nobody is watching.
+// Without viewers the data is still needed for the history and AFK tracking.
+func nextDataInterval(cfg *ServerConfig, interval time.Duration, viewers bool) time.Duration {
+	if viewers {
+		return cfg.DataIntervalMin
 	}
 
-	isSlow := os.Getenv(server+"_speed") == "slow"
+	interval *= 2
+	if interval > cfg.DataIntervalMax {
+		return cfg.DataIntervalMax
+	}
 
-	url := "http://" + server + ".op-framework.com/op-framework/world.json"
+	return interval
+}
 
-	client := &http.Client{
-		Timeout: 10 * time.Second,
+// dataWakeup returns the channel which interrupts the slow polling of a server when a map viewer connects
+func dataWakeup(server string) chan struct{} {
+	dataWakeupsMutex.Lock()
+	defer dataWakeupsMutex.Unlock()
+
+	ch, ok := dataWakeups[server]
+	if !ok {
+		ch = make(chan struct{}, 1)
+		dataWakeups[server] = ch
 	}
 
-	if isSlow {
-		client.Timeout = 15 * time.Second
+	return ch
+}
+
+func wakeDataLoop(server string) {
+	select {
+	case dataWakeup(server) <- struct{}{}:
+	default:
 	}
+}
 
-	override := os.Getenv(server + "_map")
-	if override != "" {
-		if strings.Contains(override, "localhost") {
-			url = "http://" + override + "/op-framework/world.json"
-		} else {
-			url = "http://" + override + "/op-framework/world.json"
+// processData runs the world state of a server (polled or pushed) through the tracking and broadcasts it to the map sockets
+func processData(server string, data *Data, info *InfoPackage) {
+	extraData(server, data)
+
+	var b []byte
+	var frame *MapFrame
+	if data == nil {
+		now := time.Now()
+
+		lastErrorMutex.Lock()
+		if lastError[server] == nil || now.Sub(*lastError[server]) > 30*time.Minute {
+			log.Warning("Failed to load data from " + server)
+			lastError[server] = &now
 		}
+		lastErrorMutex.Unlock()
+
+		if info != nil {
+			b, _ = json.Marshal(info)
 
-		client.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
+			serverErrorsMutex.Lock()
+			serverErrors[server] = b
+			serverErrorsMutex.Unlock()
+		} else {
+			b, _ = json.Marshal(nil)
+		}
+	} else {
+		lastDutyMutex.Lock()
+		last := lastDuty[server]
+		lastDutyMutex.Unlock()
+
+		frame = &MapFrame{
+			Players: CompressPlayers(server, data.Players),
+			Duty:    CompressDuty(last),
+			Viewers: getSteamIdentifiersByTypeAndServer(SocketTypeMap, server),
+			AFK:     popAFKEvents(server),
+			Flags:   popFlagEvents(server),
 		}
-	}
 
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		log.Error(server + " - Failed to create request: " + err.Error())
-		return nil, nil, nil
+		serverErrorsMutex.Lock()
+		serverErrors[server] = nil
+		serverErrorsMutex.Unlock()
 	}
-	req.Header.Set("Authorization", "Bearer "+token)
 
-	time10 := 10 * time.Minute
-	time15s := 10 * time.Second
+	if frame != nil {
+		broadcastToSocketFunc(server, SocketTypeMap, frame.For)
+	} else {
+		encoded := make(map[string]*Payload)
 
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Warning(server + " - Retrying data load in 15 sec")
-		time.Sleep(time15s)
-		resp, err = client.Do(req)
-
-		if err != nil {
-			if nErr, ok := err.(net.Error); ok && nErr.Timeout() {
-				log.Error(server + " - Connection timed out")
-				return nil, &time10, &InfoPackage{"Connection timed out (likely rate-limit)", http.StatusGatewayTimeout}
+		broadcastToSocketFunc(server, SocketTypeMap, func(conn *Connection) *Payload {
+			if _, ok := encoded[conn.Format]; !ok {
+				encoded[conn.Format] = newPayload(transcode(conn.Format, b))
 			}
 
-			log.Error(server + " - Failed to do request: " + err.Error())
-			return nil, nil, &InfoPackage{"Failed to get data", http.StatusInternalServerError}
-		}
+			return encoded[conn.Format]
+		})
 	}
+}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Error(server + " - Failed to read body: " + err.Error())
-		return nil, nil, nil
-	}
+func getData(server string) (*Data, *InfoPackage) {
+	breaker := getBreaker(server, EndpointWorld)
 
-	sleep15 := 15 * time.Minute
-	sleep5 := 5 * time.Minute
-	switch resp.StatusCode {
-	case 401:
-		log.Warning(server + " - 401 Unauthorized (invalid token?)")
-		return nil, &sleep15, &InfoPackage{"Unauthorized (server)", http.StatusServiceUnavailable}
-	case 504:
-		log.Warning(server + " - 504 Gateway timeout (origin error)")
-		return nil, &sleep15, &InfoPackage{"Gateway timeout", http.StatusServiceUnavailable}
-	case 502:
-		log.Warning(server + " - 502 Bad Gateway (origin error)")
-		return nil, &sleep15, &InfoPackage{"Bad Gateway", http.StatusServiceUnavailable}
-	case 521:
-		log.Warning(server + " - 521 Origin Down (server down/restarting)")
-		return nil, &sleep5, &InfoPackage{"Origin Down", http.StatusServiceUnavailable}
-	case 522:
-		log.Warning(server + " - 522 Origin Connection Time-out (possibly server down/restarting)")
-		return nil, &sleep5, &InfoPackage{"Origin Connection Time-out", http.StatusServiceUnavailable}
+	body, info := requestUpstream(server, EndpointWorld, "/op-framework/world.json", false)
+	if info != nil {
+		return nil, info
 	}
 
 	var data struct {
 		Status int64 `json:"statusCode"`
 		Data   *Data `json:"data"`
 	}
-	err = json.Unmarshal(body, &data)
+	err := json.Unmarshal(body, &data)
 	if err != nil {
-		log.Debug(url)
+		breaker.Failure(0)
+
 		log.Debug(string(body))
 		log.Error(server + " - Failed parse response: " + err.Error())
-		return nil, nil, &InfoPackage{"Invalid response from server", http.StatusBadGateway}
+		return nil, breaker.Annotate(&InfoPackage{Message: "Invalid response from server", Status: http.StatusBadGateway})
 	}
 
 	if data.Status != 200 {
 		if data.Status == 401 {
+			breaker.Failure(0)
+
 			log.Warning(server + " - 401 Unauthorized (route says: invalid token)")
-			return nil, &sleep15, &InfoPackage{"Unauthorized (route)", http.StatusServiceUnavailable}
+			return nil, breaker.Annotate(&InfoPackage{Message: "Unauthorized (route)", Status: http.StatusServiceUnavailable})
 		}
 
 		log.Warning(fmt.Sprintf(server+" - Status code for "+server+" is not 200 but %d", data.Status))
 	}
 
-	return data.Data, nil, nil
+	breaker.Success()
+
+	return data.Data, nil
 }
 
 func extraData(server string, data *Data) {
@@ -246,125 +206,159 @@ func extraData(server string, data *Data) {
 		return
 	}
 
-	lastPositionMutex.Lock()
-	_, ok := lastPosition[server]
-	if !ok {
-		lastPosition[server] = make(map[string]MovementLog)
-	}
-	lastPositionMutex.Unlock()
-
-	lastInvisibleMutex.Lock()
-	_, ok = lastInvisible[server]
-	if !ok {
-		lastInvisible[server] = make(map[string]int64)
-	}
-	lastInvisibleMutex.Unlock()
-
 	now := time.Now().Unix()
 
 	validIDs := make(map[string]bool, 0)
-	for i, player := range data.Players {
-		id := player["steamIdentifier"].(string)
+	occupants := make(map[int64][]Player)
+	for i := range data.Players {
+		player := &data.Players[i]
+
+		id := player.SteamIdentifier
 		validIDs[id] = true
 
-		character, ok := player["character"].(map[string]interface{})
+		// User flags belong to the steam identifier, so they are tracked independently of the character
+		trackFlags(server, id, 0, getUserFlags(*player), now)
 
-		if ok {
-			flags := getCharacterFlags(character)
+		if player.Character != nil {
+			flags := getCharacterFlags(player.Character)
 
-			lastInvisibleMutex.Lock()
-			t, ok := lastInvisible[server][id]
+			trackFlags(server, id, player.Character.ID, flags, now)
 
-			if flags.Invisible && !ok {
-				lastInvisible[server][id] = now
-				t = now
-			} else if !flags.Invisible && ok {
-				delete(lastInvisible[server], id)
-			} else if t == 0 {
+			t := flagActiveSince(server, id, FlagInvisible)
+			if t == 0 {
 				t = now
 			}
-			lastInvisibleMutex.Unlock()
 
-			data.Players[i]["invisible_since"] = now - t
+			player.InvisibleSince = now - t
+		} else {
+			trackFlags(server, id, 0, decodeCharacterFlags(0), now)
 		}
 
-		vehicle := player["vehicle"]
-		if vehicle != nil {
-			v, ok := vehicle.(map[string]interface{})
-
-			if ok && v != nil {
-				hash, ok := v["model"].(float64)
+		if player.Vehicle != nil {
+			var model VehicleModel
 
-				if ok {
-					key := fmt.Sprintf("%.0f", hash)
+			if player.Vehicle.Hash != 0 {
+				var found bool
+				model, found = vehicleAddonMap.Find(player.Vehicle.Hash)
 
-					found, modelName := vehicleAddonMap.Find(key)
+				if !found {
+					model = fallbackVehicleModel(strconv.FormatInt(player.Vehicle.Hash, 10))
 
-					if found {
-						v["model"] = modelName
-					} else {
-						log.Warning(fmt.Sprintf("No hash mapping found for hash %s", key))
-					}
-
-					data.Players[i]["vehicle"] = v
-				} else if model, ok := v["model"].(string); ok {
-					v["model"] = model
+					reportUnknownVehicle(player.Vehicle.Hash)
 				}
+			} else {
+				model = vehicleAddonMap.FindModel(player.Vehicle.Model)
 			}
+
+			player.Vehicle.Model = model.Model
+			player.Vehicle.Metadata = model
+
+			occupants[player.Vehicle.ID] = append(occupants[player.Vehicle.ID], *player)
 		}
 
-		err := logCoordsForPlayer(server, id, player)
+		err := logCoordsForPlayer(server, id, *player)
 		if err != nil {
 			log.Warning("Failed to log historic data for '" + id + "': " + err.Error())
 		}
 	}
 
-	lastInvisibleMutex.Lock()
-	for id := range lastInvisible[server] {
-		if !validIDs[id] {
-			delete(lastInvisible[server], id)
-		}
-	}
-	lastInvisibleMutex.Unlock()
+	cleanupFlags(server, validIDs, now)
 
-	lastPositionMutex.Lock()
-	for id := range lastPosition[server] {
-		if !validIDs[id] {
-			delete(lastPosition[server], id)
-		}
-	}
+	trackVehicles(server, occupants, now)
 
-	if time.Now().Sub(lastPositionSave) > 5*time.Minute {
-		b, _ := json.Marshal(lastPosition)
-		_ = ioutil.WriteFile("afk.json", b, 0777)
-	}
-	lastPositionMutex.Unlock()
+	cleanupAFK(server, validIDs)
 }
 
 func getSteamIdentifiersByTypeAndServer(typ, server string) []string {
 	steamIdentifiers := make([]string, 0)
 
-	connectionsMutex.Lock()
-	connections, ok := serverConnections[server]
-	connectionsMutex.Unlock()
+	for _, conn := range socketConnections(server, typ) {
+		conn.Mutex.Lock()
+		steamIdentifiers = append(steamIdentifiers, conn.Steam)
+		conn.Mutex.Unlock()
+	}
 
-	if !ok {
-		return steamIdentifiers
+	return steamIdentifiers
+}
+
+// For returns the frame for the given connection, frames are only encoded once per permission set and format
+func (f *MapFrame) For(conn *Connection) *Payload {
+	invisible := conn.Session.Can(PermissionInvisible)
+	audit := conn.Session.Can(PermissionAudit)
+
+	key := fmt.Sprintf("%t/%t/%t/%s", invisible, audit, conn.Verbose, conn.Format)
+	if b, ok := f.cache[key]; ok {
+		return b
 	}
 
-	for id, conn := range connections {
-		if conn != nil {
-			if conn.Type != typ {
+	players := f.Players
+	afk := f.AFK
+
+	if !invisible {
+		hidden := make(map[string]bool)
+		players = make([]CPlayer, 0, len(f.Players))
+
+		for _, player := range f.Players {
+			if player.Character != nil && decodeCharacterFlags(player.Character.Flags)[FlagInvisible] {
+				hidden[player.Steam] = true
 				continue
 			}
 
-			conn.Mutex.Lock()
-			steamIdentifiers = append(steamIdentifiers, conn.Steam)
-			conn.Mutex.Unlock()
-		} else {
-			delete(serverConnections[server], id)
+			players = append(players, player)
+		}
+
+		afk = make([]AFKEvent, 0, len(f.AFK))
+		for _, event := range f.AFK {
+			if !hidden[event.Steam] {
+				afk = append(afk, event)
+			}
 		}
 	}
 
-	return steamIdentifiers
+	// Verbose clients receive the names of the set flags, so they don't have to know the bit-fields
+	if conn.Verbose {
+		named := make([]CPlayer, len(players))
+
+		for i, player := range players {
+			player.FlagNames = config.Flags.User.Names(player.Flags)
+
+			if player.Character != nil {
+				character := *player.Character
+				character.FlagNames = config.Flags.Character.Names(character.Flags)
+
+				player.Character = &character
+			}
+
+			named[i] = player
+		}
+
+		players = named
+	}
+
+	frame := map[string]interface{}{
+		"p": players,
+		"d": f.Duty,
+		"s": f.Viewers,
+		"a": afk,
+	}
+
+	if audit {
+		frame["f"] = f.Flags
+	}
+
+	var b []byte
+	if conn.Format == FormatMsgpack {
+		b, _ = msgpackMarshal(frame)
+	} else {
+		b, _ = json.Marshal(frame)
+	}
+
+	payload := newPayload(b)
+
+	if f.cache == nil {
+		f.cache = make(map[string]*Payload)
+	}
+	f.cache[key] = payload
+
+	return payload
 }
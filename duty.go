@@ -2,23 +2,16 @@ package main
 
 import (
 	"bytes"
-	"crypto/tls"
 	"encoding/json"
-	"github.com/subosito/gotenv"
-	"io/ioutil"
+	"fmt"
 	"net/http"
-	"os"
-	"regexp"
-	"strings"
+	"sync"
 	"time"
 )
 
 type DutyResponse struct {
-	StatusCode int64 `json:"statusCode"`
-	Data       struct {
-		Police []OnDutyPlayer `json:"Law Enforcement"`
-		EMS    []OnDutyPlayer `json:"Medical"`
-	} `json:"data"`
+	StatusCode int64                     `json:"statusCode"`
+	Data       map[string][]OnDutyPlayer `json:"data"`
 }
 type EmptyDutyResponse struct {
 	StatusCode int64         `json:"statusCode"`
@@ -32,119 +25,243 @@ type OnDutyPlayer struct {
 }
 
 type OnDutyList struct {
-	Police []OnDutyPlayer `json:"police"`
-	EMS    []OnDutyPlayer `json:"ems"`
+	Departments map[string][]OnDutyPlayer `json:"departments"`
 }
 
+type DutyEvent struct {
+	Type            string `json:"type"`
+	Department      string `json:"department"`
+	CharacterId     int64  `json:"characterId"`
+	SteamIdentifier string `json:"steamIdentifier"`
+	Time            int64  `json:"time"`
+}
+
+type DutyUpdate struct {
+	Events []DutyEvent      `json:"events"`
+	Counts map[string]int64 `json:"counts"`
+}
+
+const (
+	DutyEventJoin  = "join"
+	DutyEventLeave = "leave"
+
+	DepartmentPolice  = "Law Enforcement"
+	DepartmentMedical = "Medical"
+)
+
+var (
+	// dutyPrevious is the last successfully loaded duty list, which changes are compared against
+	dutyPrevious = make(map[string]OnDutyList)
+
+	lastDutyUpdate      = make(map[string][]byte)
+	lastDutyUpdateMutex sync.Mutex
+)
+
 func startDutyLoop() {
-	b, _ := ioutil.ReadFile(".env")
-	env := gotenv.Parse(bytes.NewReader(b))
-
-	servers := make([]string, 0)
-	for server := range env {
-		rgx := regexp.MustCompile(`(?m)^c\d+s\d+$`)
-		if rgx.MatchString(server) && os.Getenv(server) != "" {
-			servers = append(servers, server)
+	for _, s := range config.ServerNames() {
+		cfg, _ := getServerConfig(s)
+		if cfg.Mode == ModePush {
+			continue
 		}
-	}
 
-	for _, s := range servers {
 		go func(server string) {
-			for {
-				onDutyList := getDuty(server)
+			breaker := getBreaker(server, EndpointDuty)
 
-				lastDutyMutex.Lock()
-				lastDuty[server] = onDutyList
-				lastDutyMutex.Unlock()
+			for {
+				onDutyList, info := upstreams[server].FetchDuty()
 
-				isSlow := os.Getenv(server+"_speed") == "slow"
+				processDuty(server, onDutyList, info)
 
-				if isSlow {
-					time.Sleep(30 * time.Second)
-				} else {
-					time.Sleep(15 * time.Second)
-				}
+				time.Sleep(breaker.Delay(cfg.DutyInterval))
 			}
 		}(s)
 	}
 }
 
-func getDuty(server string) OnDutyList {
-	emptyList := OnDutyList{
-		Police: []OnDutyPlayer{},
-		EMS:    []OnDutyPlayer{},
+// processDuty stores the duty list of a server (polled or pushed) and broadcasts changes to the duty sockets
+func processDuty(server string, onDutyList OnDutyList, info *InfoPackage) {
+	lastDutyMutex.Lock()
+	lastDuty[server] = onDutyList
+	previous, hasPrevious := dutyPrevious[server]
+	if info == nil {
+		dutyPrevious[server] = onDutyList
 	}
+	lastDutyMutex.Unlock()
 
-	isSlow := os.Getenv(server+"_speed") == "slow"
+	// Failed requests return an empty list, which would otherwise show up as everyone going off duty
+	if info != nil {
+		b, _ := json.Marshal(info)
 
-	url := "http://" + server + ".op-framework.com/op-framework/duty.json"
+		// Stored as the last update so newly connected clients see the error and the next snapshot is always sent
+		lastDutyUpdateMutex.Lock()
+		changed := !bytes.Equal(lastDutyUpdate[server], b)
+		lastDutyUpdate[server] = b
+		lastDutyUpdateMutex.Unlock()
 
-	token := os.Getenv(server)
-	if token == "" {
-		log.Error(server + " - No token defined")
-		return emptyList
-	}
+		if changed {
+			broadcastToSocket(server, b, SocketTypeDuty)
+		}
 
-	client := &http.Client{
-		Timeout: 10 * time.Second,
+		return
 	}
 
-	if isSlow {
-		client.Timeout = 15 * time.Second
+	events := make([]DutyEvent, 0)
+	if hasPrevious {
+		events = diffDuty(previous, onDutyList)
 	}
 
-	override := os.Getenv(server + "_map")
-	if override != "" {
-		if strings.Contains(override, "localhost") {
-			url = "http://" + override + "/op-framework/duty.json"
-		} else {
-			url = "http://" + override + "/op-framework/duty.json"
-		}
+	counts := countDuty(onDutyList)
 
-		client.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
-		}
+	// Newly connected clients only receive the current counts, not events they already missed
+	snapshot, _ := json.Marshal(DutyUpdate{
+		Events: []DutyEvent{},
+		Counts: counts,
+	})
+
+	lastDutyUpdateMutex.Lock()
+	changed := !bytes.Equal(lastDutyUpdate[server], snapshot)
+	lastDutyUpdate[server] = snapshot
+	lastDutyUpdateMutex.Unlock()
+
+	if len(events) > 0 || changed {
+		b, _ := json.Marshal(DutyUpdate{
+			Events: events,
+			Counts: counts,
+		})
+
+		broadcastToSocket(server, b, SocketTypeDuty)
 	}
+}
 
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		log.Error(server + " - Failed to create request: " + err.Error())
-		return emptyList
+func getDuty(server string) (OnDutyList, *InfoPackage) {
+	emptyList := OnDutyList{
+		Departments: map[string][]OnDutyPlayer{},
 	}
 
-	req.Header.Set("Authorization", "Bearer "+token)
+	breaker := getBreaker(server, EndpointDuty)
 
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Error(server + " - Failed to do request: " + err.Error())
-		return emptyList
+	body, info := requestUpstream(server, EndpointDuty, "/op-framework/duty.json", true)
+	if info != nil {
+		return emptyList, info
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Error(server + " - Failed to read body: " + err.Error())
-		return emptyList
+	list, ok := parseDuty(server, body)
+	if !ok {
+		breaker.Failure(0)
+
+		return emptyList, breaker.Annotate(&InfoPackage{Message: "Invalid response from server", Status: http.StatusBadGateway})
+	}
+
+	breaker.Success()
+
+	return list, nil
+}
+
+// parseDuty reads a duty.json response, which is either grouped by department or an empty list
+func parseDuty(server string, body []byte) (OnDutyList, bool) {
+	emptyList := OnDutyList{
+		Departments: map[string][]OnDutyPlayer{},
 	}
 
 	var duty DutyResponse
-	err = json.Unmarshal(body, &duty)
+	err := json.Unmarshal(body, &duty)
 	if err != nil {
 		var empty EmptyDutyResponse
 		err = json.Unmarshal(body, &empty)
 		if err != nil {
 			log.Error(server + " - Failed parse response: " + err.Error())
+			return emptyList, false
 		}
-		return emptyList
+		return emptyList, true
 	}
 
 	if duty.StatusCode != 200 {
-		return emptyList
+		return emptyList, false
 	}
 
-	return OnDutyList{
-		Police: duty.Data.Police,
-		EMS:    duty.Data.EMS,
+	list := OnDutyList{
+		Departments: make(map[string][]OnDutyPlayer, len(duty.Data)),
 	}
+
+	for department, players := range duty.Data {
+		if players == nil {
+			players = []OnDutyPlayer{}
+		}
+
+		for i := range players {
+			if players[i].Department == "" {
+				players[i].Department = department
+			}
+		}
+
+		list.Departments[department] = players
+	}
+
+	return list, true
+}
+
+// Get returns the players on duty in the given department (never nil)
+func (l OnDutyList) Get(department string) []OnDutyPlayer {
+	players, ok := l.Departments[department]
+	if !ok || players == nil {
+		return []OnDutyPlayer{}
+	}
+
+	return players
+}
+
+func diffDuty(previous, current OnDutyList) []DutyEvent {
+	now := time.Now().Unix()
+
+	before := dutyPlayerSet(previous)
+	after := dutyPlayerSet(current)
+
+	events := make([]DutyEvent, 0)
+	for key, player := range after {
+		if _, ok := before[key]; !ok {
+			events = append(events, newDutyEvent(DutyEventJoin, player, now))
+		}
+	}
+
+	for key, player := range before {
+		if _, ok := after[key]; !ok {
+			events = append(events, newDutyEvent(DutyEventLeave, player, now))
+		}
+	}
+
+	return events
+}
+
+func dutyPlayerSet(list OnDutyList) map[string]OnDutyPlayer {
+	set := make(map[string]OnDutyPlayer)
+
+	for _, players := range list.Departments {
+		for _, player := range players {
+			key := fmt.Sprintf("%s/%s/%d", player.Department, player.SteamIdentifier, player.CharacterId)
+
+			set[key] = player
+		}
+	}
+
+	return set
+}
+
+func newDutyEvent(typ string, player OnDutyPlayer, now int64) DutyEvent {
+	return DutyEvent{
+		Type:            typ,
+		Department:      player.Department,
+		CharacterId:     player.CharacterId,
+		SteamIdentifier: player.SteamIdentifier,
+		Time:            now,
+	}
+}
+
+func countDuty(list OnDutyList) map[string]int64 {
+	counts := make(map[string]int64, len(list.Departments))
+
+	for department, players := range list.Departments {
+		counts[department] = int64(len(players))
+	}
+
+	return counts
 }
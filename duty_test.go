@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func lastTestDutyUpdate(t *testing.T, server string) DutyUpdate {
+	t.Helper()
+
+	lastDutyUpdateMutex.Lock()
+	b := lastDutyUpdate[server]
+	lastDutyUpdateMutex.Unlock()
+
+	var update DutyUpdate
+
+	err := json.Unmarshal(b, &update)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return update
+}
+
+func TestDutyEvents(t *testing.T) {
+	server := "c9s9"
+
+	body := []byte(`{"statusCode": 200, "data": {"police": [{"characterId": 1, "steamIdentifier": "steam:1"}], "bcfd": null}}`)
+
+	list, ok := parseDuty(server, body)
+	if !ok || list.Get("police")[0].Department != "police" || list.Get("bcfd") == nil || list.Get("doj") == nil {
+		t.Fatalf("expected departments to be read from the keys, got %+v", list)
+	}
+
+	previous := list
+
+	body = []byte(`{"statusCode": 200, "data": {"police": [{"characterId": 2, "steamIdentifier": "steam:2"}], "tow": [{"characterId": 1, "steamIdentifier": "steam:1"}]}}`)
+
+	list, ok = parseDuty(server, body)
+	if !ok {
+		t.Fatal("expected the duty list to be valid")
+	}
+
+	events := diffDuty(previous, list)
+
+	joined := make(map[string]string)
+	left := make(map[string]string)
+	for _, event := range events {
+		if event.Type == DutyEventJoin {
+			joined[event.SteamIdentifier] = event.Department
+		} else {
+			left[event.SteamIdentifier] = event.Department
+		}
+	}
+
+	// Switching departments is a leave and a join
+	if !reflect.DeepEqual(joined, map[string]string{"steam:1": "tow", "steam:2": "police"}) || !reflect.DeepEqual(left, map[string]string{"steam:1": "police"}) {
+		t.Errorf("expected join and leave events, got %+v", events)
+	}
+
+	if counts := countDuty(list); !reflect.DeepEqual(counts, map[string]int64{"police": 1, "tow": 1}) {
+		t.Errorf("expected counts per department, got %+v", counts)
+	}
+
+	if _, ok = parseDuty(server, []byte(`{"statusCode": 200, "data": []}`)); !ok {
+		t.Error("expected an empty list to be valid")
+	}
+}
+
+func TestDutyFailedRequest(t *testing.T) {
+	server := "c9s9"
+
+	list, _ := parseDuty(server, []byte(`{"statusCode": 200, "data": {"police": [{"characterId": 1, "steamIdentifier": "steam:1"}]}}`))
+
+	processDuty(server, list, nil)
+
+	if update := lastTestDutyUpdate(t, server); update.Counts["police"] != 1 || len(update.Events) != 0 {
+		t.Fatalf("expected the snapshot to only contain the counts, got %+v", update)
+	}
+
+	// A failed request doesn't count as everyone going off duty
+	processDuty(server, OnDutyList{Departments: map[string][]OnDutyPlayer{}}, &InfoPackage{Message: "Gateway timeout", Status: http.StatusServiceUnavailable})
+
+	lastDutyMutex.Lock()
+	previous := dutyPrevious[server]
+	lastDutyMutex.Unlock()
+
+	if len(previous.Get("police")) != 1 {
+		t.Fatal("expected the failed request not to replace the previous list")
+	}
+
+	processDuty(server, list, nil)
+
+	if update := lastTestDutyUpdate(t, server); update.Counts["police"] != 1 {
+		t.Errorf("expected the snapshot to be sent again after the error, got %+v", update)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type FlagRecord struct {
+	Steam       string `json:"steam"`
+	CharacterID int64  `json:"characterId"`
+	Flag        string `json:"flag"`
+	Start       int64  `json:"start"`
+	End         int64  `json:"end"`
+	Duration    int64  `json:"duration"`
+	Active      bool   `json:"active"`
+
+	// since is when the flag was set, Start is moved forward when a long record is split
+	since int64
+}
+
+type FlagEvent struct {
+	Type        string `json:"type"`
+	Steam       string `json:"steam"`
+	CharacterID int64  `json:"characterId"`
+	Flag        string `json:"flag"`
+	Since       int64  `json:"since"`
+	Duration    int64  `json:"duration"`
+	Time        int64  `json:"time"`
+}
+
+const (
+	FlagEventStart = "start"
+	FlagEventEnd   = "end"
+)
+
+var (
+	flagStates      = make(map[string]map[string]*FlagRecord)
+	flagEvents      = make(map[string][]FlagEvent)
+	flagStatesMutex sync.Mutex
+
+	flagAuditFileMutex sync.Mutex
+)
+
+func flagStateKey(steam, flag string) string {
+	return steam + "/" + flag
+}
+
+// trackFlags starts or ends a flag record for every flag of the given player
+func trackFlags(server, steam string, characterID int64, flags map[string]bool, now int64) {
+	flagStatesMutex.Lock()
+	defer flagStatesMutex.Unlock()
+
+	if flagStates[server] == nil {
+		flagStates[server] = make(map[string]*FlagRecord)
+	}
+
+	for flag, active := range flags {
+		key := flagStateKey(steam, flag)
+		record, tracked := flagStates[server][key]
+
+		// Clearing the flag or switching characters ends the current record
+		if tracked && (!active || record.CharacterID != characterID) {
+			endFlagRecord(server, record, now)
+			delete(flagStates[server], key)
+
+			tracked = false
+		}
+
+		if tracked && now-record.Start >= maxRecordDuration {
+			splitFlagRecord(server, record, now)
+		}
+
+		if active && !tracked {
+			record = &FlagRecord{
+				Steam:       steam,
+				CharacterID: characterID,
+				Flag:        flag,
+				Start:       now,
+				Active:      true,
+
+				since: now,
+			}
+
+			flagStates[server][key] = record
+
+			addFlagEvent(server, FlagEventStart, record, now)
+		}
+	}
+}
+
+// flagActiveSince returns when the given flag was set for the player or 0 if it isn't set
+func flagActiveSince(server, steam, flag string) int64 {
+	flagStatesMutex.Lock()
+	defer flagStatesMutex.Unlock()
+
+	record, ok := flagStates[server][flagStateKey(steam, flag)]
+	if !ok {
+		return 0
+	}
+
+	return record.since
+}
+
+// cleanupFlags ends all flag records of players that are no longer on the server
+func cleanupFlags(server string, validIDs map[string]bool, now int64) {
+	flagStatesMutex.Lock()
+	defer flagStatesMutex.Unlock()
+
+	for key, record := range flagStates[server] {
+		if !validIDs[record.Steam] {
+			endFlagRecord(server, record, now)
+			delete(flagStates[server], key)
+		}
+	}
+}
+
+// endFlagRecord has to be called while holding flagStatesMutex
+func endFlagRecord(server string, record *FlagRecord, now int64) {
+	record.End = now
+	record.Duration = now - record.Start
+	record.Active = false
+
+	addFlagEvent(server, FlagEventEnd, record, now)
+
+	err := logFlagRecord(server, *record)
+	if err != nil {
+		log.Warning("Failed to log " + record.Flag + " flag for '" + record.Steam + "': " + err.Error())
+	}
+}
+
+// splitFlagRecord logs the record so far and continues it from now on without emitting any events,
+// it has to be called while holding flagStatesMutex
+func splitFlagRecord(server string, record *FlagRecord, now int64) {
+	finished := *record
+	finished.End = now
+	finished.Duration = now - finished.Start
+	finished.Active = false
+
+	err := logFlagRecord(server, finished)
+	if err != nil {
+		log.Warning("Failed to log " + record.Flag + " flag for '" + record.Steam + "': " + err.Error())
+	}
+
+	record.Start = now
+}
+
+// addFlagEvent has to be called while holding flagStatesMutex
+func addFlagEvent(server, typ string, record *FlagRecord, now int64) {
+	flagEvents[server] = append(flagEvents[server], FlagEvent{
+		Type:        typ,
+		Steam:       record.Steam,
+		CharacterID: record.CharacterID,
+		Flag:        record.Flag,
+		Since:       record.since,
+		Duration:    now - record.since,
+		Time:        now,
+	})
+}
+
+// popFlagEvents returns and clears all flag events that happened since the last call
+func popFlagEvents(server string) []FlagEvent {
+	flagStatesMutex.Lock()
+	events := flagEvents[server]
+	delete(flagEvents, server)
+	flagStatesMutex.Unlock()
+
+	if events == nil {
+		return []FlagEvent{}
+	}
+
+	return events
+}
+
+func logFlagRecord(server string, record FlagRecord) error {
+	dir := config.AuditPath + "/flags/" + server + "/"
+	path := dir + time.Unix(record.End, 0).Format("2006-01-02") + ".csv"
+
+	flagAuditFileMutex.Lock()
+	defer flagAuditFileMutex.Unlock()
+
+	_ = os.MkdirAll(dir, 0777)
+
+	_, err := os.Stat(path)
+	existed := err == nil
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0777)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	if !existed {
+		_, _ = file.WriteString("Start,End,Duration,Steam,Character ID,Flag\n")
+	}
+
+	_, err = file.WriteString(fmt.Sprintf("%d,%d,%d,%s,%d,%s\n", record.Start, record.End, record.Duration, record.Steam, record.CharacterID, record.Flag))
+
+	return err
+}
+
+// getFlagRecords returns all finished and active flag records overlapping the given time range, optionally filtered by flag and steam identifier
+func getFlagRecords(server string, from, till int64, flag, steam string) ([]FlagRecord, error) {
+	if till < from {
+		return nil, errors.New("till is before from")
+	}
+
+	if till-from > 31*24*60*60 {
+		return nil, errors.New("maximum range is 31 days")
+	}
+
+	matches := func(record FlagRecord) bool {
+		return record.Start <= till && record.End >= from && (flag == "" || record.Flag == flag) && (steam == "" || record.Steam == steam)
+	}
+
+	records := make([]FlagRecord, 0)
+
+	flagAuditFileMutex.Lock()
+	for _, day := range recordDays(from, till) {
+		path := config.AuditPath + "/flags/" + server + "/" + day.Format("2006-01-02") + ".csv"
+
+		err := readFlagRecords(path, func(record FlagRecord) {
+			if matches(record) {
+				records = append(records, record)
+			}
+		})
+		if err != nil {
+			flagAuditFileMutex.Unlock()
+			return nil, err
+		}
+	}
+	flagAuditFileMutex.Unlock()
+
+	now := time.Now().Unix()
+
+	flagStatesMutex.Lock()
+	for _, state := range flagStates[server] {
+		record := *state
+		record.End = now
+		record.Duration = now - record.Start
+
+		if matches(record) {
+			records = append(records, record)
+		}
+	}
+	flagStatesMutex.Unlock()
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Start < records[j].Start
+	})
+
+	return records, nil
+}
+
+func readFlagRecords(path string, callback func(FlagRecord)) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.New("failed to read data")
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	scanner := bufio.NewScanner(file)
+	index := 0
+	for scanner.Scan() {
+		elements := strings.Split(scanner.Text(), ",")
+
+		// Skip csv header
+		if index == 0 {
+			index++
+			continue
+		}
+		index++
+
+		if len(elements) == 6 {
+			start, sErr := strconv.ParseInt(elements[0], 10, 64)
+			end, eErr := strconv.ParseInt(elements[1], 10, 64)
+			duration, dErr := strconv.ParseInt(elements[2], 10, 64)
+			cid, cErr := strconv.ParseInt(elements[4], 10, 64)
+
+			if sErr == nil && eErr == nil && dErr == nil && cErr == nil {
+				callback(FlagRecord{
+					Steam:       elements[3],
+					CharacterID: cid,
+					Flag:        elements[5],
+					Start:       start,
+					End:         end,
+					Duration:    duration,
+				})
+			} else {
+				log.Warning("Failed to read flag csv entry")
+			}
+		}
+	}
+
+	return nil
+}
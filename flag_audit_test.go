@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFlagRecordSplit(t *testing.T) {
+	useTestConfig(t, "")
+
+	server := "c9s7"
+	steam := "steam:11000010a1b2c3d"
+	now := time.Now().Unix()
+	set := now - 25*60*60
+
+	trackFlags(server, steam, 4211, map[string]bool{FlagInvisible: true}, set)
+	trackFlags(server, steam, 4211, map[string]bool{FlagInvisible: true}, now-2*60*60)
+
+	// Records are split once they last for 24 hours, without events and without changing since when the flag is set
+	trackFlags(server, steam, 4211, map[string]bool{FlagInvisible: true}, now-60*60)
+
+	if since := flagActiveSince(server, steam, FlagInvisible); since != set {
+		t.Errorf("expected the flag to be set since %d, got %d", set, since)
+	}
+
+	events := popFlagEvents(server)
+	if len(events) != 1 || events[0].Type != FlagEventStart {
+		t.Fatalf("expected a single start event, got %+v", events)
+	}
+
+	trackFlags(server, steam, 4211, map[string]bool{FlagInvisible: false}, now)
+
+	events = popFlagEvents(server)
+	if len(events) != 1 || events[0].Type != FlagEventEnd || events[0].Since != set || events[0].Duration != 25*60*60 {
+		t.Fatalf("expected an end event for the whole time, got %+v", events)
+	}
+
+	records, err := getFlagRecords(server, set-60*60, now, FlagInvisible, steam)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 2 || records[0].Start != set || records[0].Duration != 24*60*60 || records[1].Start != now-60*60 || records[1].End != now {
+		t.Fatalf("expected the record to be split after 24 hours, got %+v", records)
+	}
+
+	// The first part is stored by the day it ended, which is read for ranges up to a day earlier
+	records, err = getFlagRecords(server, set, set, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 1 || records[0].Start != set {
+		t.Errorf("expected the first part, got %+v", records)
+	}
+}
+
+func TestFlagRecordCharacterSwitch(t *testing.T) {
+	useTestConfig(t, "")
+
+	server := "c9s8"
+	steam := "steam:11000010a1b2c3d"
+	now := time.Now().Unix()
+
+	trackFlags(server, steam, 1, map[string]bool{FlagDead: true}, now-60)
+	trackFlags(server, steam, 2, map[string]bool{FlagDead: true}, now)
+
+	events := popFlagEvents(server)
+	if len(events) != 3 || events[0].Type != FlagEventStart || events[1].Type != FlagEventEnd || events[1].CharacterID != 1 || events[2].Type != FlagEventStart || events[2].CharacterID != 2 {
+		t.Errorf("expected switching characters to end the record, got %+v", events)
+	}
+
+	cleanupFlags(server, map[string]bool{}, now)
+
+	if events = popFlagEvents(server); len(events) != 1 || events[0].Type != FlagEventEnd {
+		t.Errorf("expected leaving the server to end the record, got %+v", events)
+	}
+}
@@ -1,65 +1,79 @@
 package main
 
-type UserFlags struct {
-	IdentityOverride bool
-	FakeDisconnected bool
-}
+import (
+	"sort"
+)
 
-type CharacterFlags struct {
-	Dead      bool
-	Trunk     bool
-	Shell     bool
-	Invisible bool
-}
+// FlagRegistry maps flag names to their bit in a flags bit-field
+type FlagRegistry map[string]uint
 
-func getUserFlags(player map[string]interface{}) UserFlags {
-	flags, ok := player["flags"].(int64)
+// FlagSet contains every flag of a registry and whether it is set
+type FlagSet map[string]bool
 
-	if ok {
-		FakeDisconnected := flags/2 >= 1
-		if FakeDisconnected {
-			flags -= 2
-		}
+const (
+	FlagIdentityOverride = "identity_override"
+	FlagFakeDisconnected = "fake_disconnected"
 
-		IdentityOverride := flags != 0
+	FlagDead      = "dead"
+	FlagTrunk     = "trunk"
+	FlagShell     = "shell"
+	FlagInvisible = "invisible"
+)
 
-		return UserFlags{
-			IdentityOverride: IdentityOverride,
-			FakeDisconnected: FakeDisconnected,
-		}
+var (
+	defaultUserFlags = FlagRegistry{
+		FlagIdentityOverride: 0,
+		FlagFakeDisconnected: 1,
+	}
+
+	defaultCharacterFlags = FlagRegistry{
+		FlagDead:      0,
+		FlagTrunk:     1,
+		FlagShell:     2,
+		FlagInvisible: 3,
+	}
+)
+
+// Decode returns the state of every flag in the registry, unknown bits are ignored
+func (r FlagRegistry) Decode(flags int64) FlagSet {
+	set := make(FlagSet, len(r))
+
+	for name, bit := range r {
+		set[name] = flags&(1<<bit) != 0
 	}
 
-	return UserFlags{}
+	return set
 }
 
-func getCharacterFlags(character map[string]interface{}) CharacterFlags {
-	flags, ok := character["flags"].(int64)
+// Names returns the names of all set flags ordered by their bit
+func (r FlagRegistry) Names(flags int64) []string {
+	names := make([]string, 0)
 
-	if ok {
-		Invisible := flags/8 >= 1
-		if Invisible {
-			flags -= 8
+	for name, bit := range r {
+		if flags&(1<<bit) != 0 {
+			names = append(names, name)
 		}
+	}
 
-		Shell := flags/4 >= 1
-		if Shell {
-			flags -= 4
-		}
+	sort.Slice(names, func(i, j int) bool {
+		return r[names[i]] < r[names[j]]
+	})
 
-		Trunk := flags/2 >= 1
-		if Trunk {
-			flags -= 2
-		}
+	return names
+}
 
-		Dead := flags != 0
+func getUserFlags(player Player) FlagSet {
+	return config.Flags.User.Decode(player.Flags)
+}
 
-		return CharacterFlags{
-			Invisible: Invisible,
-			Shell:     Shell,
-			Trunk:     Trunk,
-			Dead:      Dead,
-		}
+func getCharacterFlags(character *Character) FlagSet {
+	if character != nil {
+		return decodeCharacterFlags(character.Flags)
 	}
 
-	return CharacterFlags{}
+	return decodeCharacterFlags(0)
+}
+
+func decodeCharacterFlags(flags int64) FlagSet {
+	return config.Flags.Character.Decode(flags)
 }
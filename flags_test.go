@@ -0,0 +1,200 @@
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// loadTestWorld reads a synthetic world.json (invented players, not a recorded capture) in the format the server sends,
+// including float-encoded flags
+func loadTestWorld(t *testing.T) *Data {
+	t.Helper()
+
+	b, err := ioutil.ReadFile("testdata/synthetic_world.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := parseWorld(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func findTestPlayer(t *testing.T, data *Data, steam string) *Player {
+	t.Helper()
+
+	for i := range data.Players {
+		if data.Players[i].SteamIdentifier == steam {
+			return &data.Players[i]
+		}
+	}
+
+	t.Fatalf("player %s not found", steam)
+	return nil
+}
+
+func TestWorldFlags(t *testing.T) {
+	useTestConfig(t, "")
+
+	data := loadTestWorld(t)
+
+	tests := []struct {
+		steam     string
+		user      []string
+		character []string
+	}{
+		{"steam:11000010a1b2c3d", []string{FlagIdentityOverride}, []string{FlagInvisible}},
+		{"steam:11000010d4e5f60", []string{}, []string{FlagDead}},
+		{"steam:110000112345678", []string{FlagFakeDisconnected}, []string{}},
+		// Flags are numbers in world.json and decoded as float64, unknown bits are ignored
+		{"steam:1100001abcdef01", []string{FlagIdentityOverride}, []string{FlagDead, FlagInvisible}},
+	}
+
+	for _, test := range tests {
+		player := findTestPlayer(t, data, test.steam)
+
+		user := config.Flags.User.Names(player.Flags)
+		if !reflect.DeepEqual(user, test.user) {
+			t.Errorf("%s: expected user flags %v, got %v", test.steam, test.user, user)
+		}
+
+		var character []string
+		if player.Character != nil {
+			character = config.Flags.Character.Names(player.Character.Flags)
+		} else {
+			character = config.Flags.Character.Names(0)
+		}
+
+		if !reflect.DeepEqual(character, test.character) {
+			t.Errorf("%s: expected character flags %v, got %v", test.steam, test.character, character)
+		}
+
+		set := getCharacterFlags(player.Character)
+		if len(set) != len(config.Flags.Character) {
+			t.Errorf("%s: expected every character flag to be decoded, got %v", test.steam, set)
+		}
+
+		for _, name := range test.character {
+			if !set[name] {
+				t.Errorf("%s: expected %s to be set in %v", test.steam, name, set)
+			}
+		}
+
+		if getUserFlags(*player)[FlagFakeDisconnected] != (test.steam == "steam:110000112345678") {
+			t.Errorf("%s: unexpected %s state", test.steam, FlagFakeDisconnected)
+		}
+	}
+}
+
+func TestWorldFlagsDecodedAsFloat(t *testing.T) {
+	useTestConfig(t, "")
+
+	data, err := parseWorld([]byte(`{"players": [{"steamIdentifier": "steam:1", "flags": 2.0, "character": {"id": 1, "flags": "8"}}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	player := data.Players[0]
+
+	if player.Flags != 2 || !getUserFlags(player)[FlagFakeDisconnected] {
+		t.Errorf("expected user flags 2, got %d", player.Flags)
+	}
+
+	if player.Character.Flags != 8 || !getCharacterFlags(player.Character)[FlagInvisible] {
+		t.Errorf("expected character flags 8, got %d", player.Character.Flags)
+	}
+}
+
+func TestInvisibleSince(t *testing.T) {
+	useTestConfig(t, "")
+
+	data := loadTestWorld(t)
+	server := "c9s1"
+
+	invisible := findTestPlayer(t, data, "steam:11000010a1b2c3d")
+
+	// The flag was already set two minutes ago
+	now := time.Now().Unix()
+	trackFlags(server, invisible.SteamIdentifier, invisible.Character.ID, getCharacterFlags(invisible.Character), now-120)
+
+	extraData(server, data)
+
+	since := findTestPlayer(t, data, "steam:11000010a1b2c3d").InvisibleSince
+	if since < 120 || since > 125 {
+		t.Errorf("expected to be invisible for 120 seconds, got %d", since)
+	}
+
+	if since := findTestPlayer(t, data, "steam:11000010d4e5f60").InvisibleSince; since != 0 {
+		t.Errorf("expected a visible player to have no invisible_since, got %d", since)
+	}
+
+	// Players that just became invisible start at 0
+	if since := findTestPlayer(t, data, "steam:1100001abcdef01").InvisibleSince; since != 0 {
+		t.Errorf("expected a newly invisible player to start at 0, got %d", since)
+	}
+
+	if active := flagActiveSince(server, "steam:1100001abcdef01", FlagInvisible); active == 0 {
+		t.Error("expected the invisible flag to be tracked")
+	}
+}
+
+func TestConfiguredFlagBits(t *testing.T) {
+	useTestConfig(t, `
+flags:
+  user:
+    muted: 5
+  character:
+    cuffed: 5
+    invisible: 6
+`)
+
+	data := loadTestWorld(t)
+
+	if config.Flags.Character[FlagDead] != 0 || config.Flags.User[FlagIdentityOverride] != 0 {
+		t.Errorf("expected the default flags to be kept, got %v and %v", config.Flags.User, config.Flags.Character)
+	}
+
+	// Character flags 33 are dead (bit 0) and cuffed (bit 5)
+	player := findTestPlayer(t, data, "steam:11000010d4e5f60")
+
+	names := config.Flags.Character.Names(player.Character.Flags)
+	if !reflect.DeepEqual(names, []string{FlagDead, "cuffed"}) {
+		t.Errorf("expected dead and cuffed, got %v", names)
+	}
+
+	// Overriding the bit of a default flag moves it
+	player = findTestPlayer(t, data, "steam:11000010a1b2c3d")
+	if getCharacterFlags(player.Character)[FlagInvisible] {
+		t.Error("expected bit 3 to no longer be invisible")
+	}
+
+	if !config.Flags.User.Decode(32)["muted"] {
+		t.Error("expected bit 5 to be muted")
+	}
+}
+
+func TestFlagBitValidation(t *testing.T) {
+	useTestConfig(t, `
+flags:
+  character:
+    cuffed: 63
+    hooded: 0
+`)
+
+	err := config.validate()
+	if err == nil {
+		t.Fatal("expected an invalid flag configuration")
+	}
+
+	for _, problem := range []string{"flags.character.cuffed has to be a bit between 0 and 62", "use the same bit"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("expected %q in %q", problem, err.Error())
+		}
+	}
+}
@@ -9,5 +9,7 @@ require (
 	github.com/mattn/go-colorable v0.1.8
 	github.com/rs/xid v1.3.0
 	github.com/subosito/gotenv v1.2.0
+	github.com/ugorji/go/codec v1.1.7
 	gitlab.com/milan44/logger v1.1.4
+	gopkg.in/yaml.v2 v2.2.8
 )
@@ -2,12 +2,15 @@ package main
 
 import (
 	"github.com/gin-gonic/gin"
-	"os"
-	"regexp"
+	"strings"
 	"time"
 )
 
-func checkSession(c *gin.Context, jsonResponse bool) bool {
+// maxRecordDuration (in seconds) is how long flag records and vehicle sessions last before they are split
+const maxRecordDuration = 24 * 60 * 60
+
+// checkSession authenticates the request and makes sure the session has the given permission (if not empty)
+func checkSession(c *gin.Context, jsonResponse bool, permission string) bool {
 	ginLogger(c)
 
 	session := c.PostForm("token")
@@ -17,20 +20,18 @@ func checkSession(c *gin.Context, jsonResponse bool) bool {
 
 	cluster := c.Query("cluster")
 
-	if session == "" || !validSession(session, cluster) {
-		oneTimeToken := c.Query("ott")
-		now := time.Now()
-
-		oneTimeTokenMutex.Lock()
-		v, ok := oneTimeTokens[oneTimeToken]
-		oneTimeTokenMutex.Unlock()
-
-		if ok && now.Sub(v.time) < 1*time.Minute && v.cluster == cluster {
-			oneTimeTokenMutex.Lock()
-			delete(oneTimeTokens, oneTimeToken)
-			oneTimeTokenMutex.Unlock()
+	var s *Session
+	if session != "" {
+		s, _ = authenticator.Authenticate(session, cluster)
+		if s != nil {
+			s.token = session
+		}
+	}
 
-			return true
+	if s == nil {
+		s = useOneTimeToken(c, c.Query("ott"), cluster, permission)
+		if s != nil {
+			return checkPermission(c, s, jsonResponse, permission)
 		}
 
 		if jsonResponse {
@@ -46,21 +47,59 @@ func checkSession(c *gin.Context, jsonResponse bool) bool {
 		return false
 	}
 
-	return true
+	return checkPermission(c, s, jsonResponse, permission)
 }
 
-func validSession(session, cluster string) bool {
-	rgx := regexp.MustCompile(`(?mi)[^a-z0-9]`)
-	session = rgx.ReplaceAllString(session, "")
-	if session == "" {
-		return false
-	}
+func checkPermission(c *gin.Context, s *Session, jsonResponse bool, permission string) bool {
+	if permission != "" && !s.Can(permission) {
+		if s != nil {
+			log.Info("Rejected " + s.Steam + " (" + strings.Join(s.Roles, ", ") + ") missing permission '" + permission + "'")
+		}
 
-	sessionFile := SessionDirectory + "/" + cluster + session + ".session"
-	if _, err := os.Stat(sessionFile); err != nil {
-		log.Debug("Unable to find '" + sessionFile + "'")
+		if jsonResponse {
+			c.JSON(200, map[string]interface{}{
+				"status": false,
+				"error":  "forbidden",
+			})
+		} else {
+			c.Data(403, "text/plain", []byte("Forbidden"))
+		}
+
+		c.Abort()
 		return false
 	}
 
+	c.Set("session", s)
+
 	return true
 }
+
+// getSession returns the session authenticated by checkSession
+func getSession(c *gin.Context) *Session {
+	s, ok := c.Get("session")
+	if !ok {
+		return nil
+	}
+
+	session, _ := s.(*Session)
+
+	return session
+}
+
+// recordDays returns the days whose files can contain records overlapping the given time range. Records are stored by
+// the day they ended, which is at most maxRecordDuration after the range.
+func recordDays(from, till int64) []time.Time {
+	end := till + maxRecordDuration
+	if now := time.Now().Unix(); end > now {
+		end = now
+	}
+
+	t := time.Unix(from, 0)
+
+	days := make([]time.Time, 0)
+	for day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location()); day.Unix() <= end; day = day.AddDate(0, 0, 1) {
+		days = append(days, day)
+	}
+
+	return days
+}
@@ -22,9 +22,9 @@ var (
 	heatmapMutex sync.Mutex
 )
 
-func logCoordsForPlayer(server, steam string, player map[string]interface{}) error {
+func logCoordsForPlayer(server, steam string, player Player) error {
 	day := time.Now().Format("2006-01-02")
-	dir := "./history/" + server + "/" + day + "/"
+	dir := config.HistoryPath + "/" + server + "/" + day + "/"
 	path := dir + strings.ReplaceAll(steam, "steam:", "") + ".csv"
 
 	_ = os.MkdirAll(dir, 0777)
@@ -53,26 +53,15 @@ func logCoordsForPlayer(server, steam string, player map[string]interface{}) err
 		}
 	}
 
-	c := getMap("coords", player)
-	character := getMap("character", player)
-
-	if c != nil && character != nil {
+	if player.Coords != nil && player.Character != nil && player.Character.ID != 0 {
 		t := time.Now().Unix()
 
-		id := getInt64("id", character)
-
-		x, xOk := c["x"].(float64)
-		y, yOk := c["y"].(float64)
-		z, zOk := c["z"].(float64)
-
-		h := getFloat64("heading", player)
+		c := player.Coords
 
-		if xOk && yOk && zOk && id != 0 {
-			// Timestamp, Character ID, X, Y, Z, Heading
-			_, err := file.WriteString(fmt.Sprintf("%d,%d,%.1f,%.1f,%.1f,%.1f\n", t, id, x, y, z, h))
-			if err != nil {
-				return err
-			}
+		// Timestamp, Character ID, X, Y, Z, Heading
+		_, err := file.WriteString(fmt.Sprintf("%d,%d,%.1f,%.1f,%.1f,%.1f\n", t, player.Character.ID, c.X, c.Y, c.Z, player.Heading))
+		if err != nil {
+			return err
 		}
 	}
 
@@ -80,15 +69,17 @@ func logCoordsForPlayer(server, steam string, player map[string]interface{}) err
 }
 
 func doHistoryCleanup() error {
-	_ = os.MkdirAll("./history/", 0777)
+	_ = os.MkdirAll(config.HistoryPath, 0777)
+
+	retention := time.Duration(config.HistoryRetentionDays) * 24 * time.Hour
 
-	return filepath.Walk("./history", func(server string, info os.FileInfo, err error) error {
+	return filepath.Walk(config.HistoryPath, func(server string, info os.FileInfo, err error) error {
 		if info.IsDir() {
 			return filepath.Walk(server, func(day string, dayInfo os.FileInfo, err error) error {
 				if dayInfo != nil && dayInfo.IsDir() {
 					t, err := time.Parse("2006-01-02", dayInfo.Name())
 
-					if err == nil && time.Now().Sub(t) > 24*10*time.Hour { // Delete if older than 10 days
+					if err == nil && time.Now().Sub(t) > retention { // Delete if older than the retention period
 						log.Info("Removing historic entries '" + day + "'")
 						return os.RemoveAll(day)
 					}
@@ -106,7 +97,7 @@ func getHistoricLocation(server, steam string, from, till int64) (interface{}, e
 	fromDay := time.Unix(from, 0).Format("2006-01-02")
 	tillDay := time.Unix(till, 0).Format("2006-01-02")
 
-	path := "./history/" + server + "/" + fromDay + "/" + steam + ".csv"
+	path := config.HistoryPath + "/" + server + "/" + fromDay + "/" + steam + ".csv"
 
 	data := make(map[int64]interface{})
 
@@ -125,7 +116,7 @@ func getHistoricLocation(server, steam string, from, till int64) (interface{}, e
 	}
 
 	if fromDay != tillDay {
-		path = "./history/" + server + "/" + tillDay + "/" + steam + ".csv"
+		path = config.HistoryPath + "/" + server + "/" + tillDay + "/" + steam + ".csv"
 
 		err = readHistoric(path, func(entry HistoricEntry) {
 			if entry.Timestamp >= from && entry.Timestamp <= till {
@@ -142,14 +133,14 @@ func getHistoricLocation(server, steam string, from, till int64) (interface{}, e
 }
 
 func generateHeatMapForDay(server, day string) (string, error) {
-	cache := "./cache/heatmap/" + server + "_" + day + ".json"
+	cache := config.CachePath + "/heatmap/" + server + "_" + day + ".json"
 
 	heatmapMutex.Lock()
 
 	stat, err := os.Stat(cache)
 	if os.IsNotExist(err) || time.Now().Sub(stat.ModTime()) > 1*time.Hour {
 		heatmap := make(map[string]int64)
-		dir := "./history/" + server + "/" + day + "/"
+		dir := config.HistoryPath + "/" + server + "/" + day + "/"
 
 		if _, err := os.Stat(dir); os.IsNotExist(err) {
 			heatmapMutex.Unlock()
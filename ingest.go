@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ModePoll = "poll"
+	ModePush = "push"
+
+	IngestWorld     = "world"
+	IngestDuty      = "duty"
+	IngestStaffChat = "staff-chat"
+
+	maxIngestSize = 16 << 20
+)
+
+type IngestMessage struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+var (
+	lastPush      = make(map[string]time.Time)
+	lastPushMutex sync.Mutex
+
+	// ingestMutexes make sure pushed data of a server is processed in order, servers don't wait for each other
+	ingestMutexes      = make(map[string]*sync.Mutex)
+	ingestMutexesMutex sync.Mutex
+)
+
+func getIngestMutex(server string) *sync.Mutex {
+	ingestMutexesMutex.Lock()
+	defer ingestMutexesMutex.Unlock()
+
+	mutex, ok := ingestMutexes[server]
+	if !ok {
+		mutex = &sync.Mutex{}
+		ingestMutexes[server] = mutex
+	}
+
+	return mutex
+}
+
+// checkServerToken authenticates a game server pushing its data with its server token
+func checkServerToken(c *gin.Context, server string) bool {
+	ginLogger(c)
+
+	cfg, ok := getServerConfig(server)
+	if !ok || cfg.Mode != ModePush {
+		c.JSON(http.StatusNotFound, map[string]interface{}{
+			"status": false,
+			"error":  "server does not accept pushed data",
+		})
+		c.Abort()
+		return false
+	}
+
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(cfg.Token)) != 1 {
+		log.Warning("Rejected data pushed to " + server + " from " + c.ClientIP() + " (invalid token)")
+
+		c.JSON(http.StatusUnauthorized, map[string]interface{}{
+			"status": false,
+			"error":  "unauthorized",
+		})
+		c.Abort()
+		return false
+	}
+
+	return true
+}
+
+func handleIngest(c *gin.Context) {
+	server := c.Param("server")
+	if !checkServerToken(c, server) {
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxIngestSize))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"status": false,
+			"error":  "failed to read body",
+		})
+		return
+	}
+
+	err = ingest(server, c.Param("type"), body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"status": false,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"status": true,
+	})
+}
+
+// handleIngestSocket accepts a persistent connection over which a game server sends {"type": "world", "data": {...}} messages
+func handleIngestSocket(c *gin.Context) {
+	server := c.Param("server")
+	if !checkServerToken(c, server) {
+		return
+	}
+
+	conn, err := wsupgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Warning("Failed to set websocket upgrade: " + err.Error())
+		return
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	conn.SetReadLimit(maxIngestSize)
+
+	log.Info(server + " - Ingest socket connected from " + c.ClientIP())
+
+	for {
+		var message IngestMessage
+
+		err = conn.ReadJSON(&message)
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Warning(server + " - Ingest socket closed: " + err.Error())
+			}
+
+			return
+		}
+
+		err = ingest(server, message.Type, message.Data)
+		if err != nil {
+			log.Warning(server + " - Invalid ingest message: " + err.Error())
+		}
+	}
+}
+
+func ingest(server, typ string, body []byte) error {
+	mutex := getIngestMutex(server)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	switch typ {
+	case IngestWorld:
+		data, err := parseWorld(body)
+		if err != nil {
+			return err
+		}
+
+		lastPushMutex.Lock()
+		lastPush[server] = time.Now()
+		lastPushMutex.Unlock()
+
+		processData(server, data, nil)
+	case IngestDuty:
+		list, ok := parseDuty(server, body)
+		if !ok {
+			return errors.New("invalid duty data")
+		}
+
+		processDuty(server, list, nil)
+	case IngestStaffChat:
+		list, ok := parseStaffChat(server, body)
+		if !ok {
+			return errors.New("invalid staff chat data")
+		}
+
+		processStaffChat(server, list, nil)
+	default:
+		return errors.New("unknown type '" + typ + "'")
+	}
+
+	return nil
+}
+
+// parseWorld reads pushed world data, either wrapped like world.json ({"statusCode": 200, "data": {...}}) or just the data
+func parseWorld(body []byte) (*Data, error) {
+	var wrapped struct {
+		Data *Data `json:"data"`
+	}
+
+	err := json.Unmarshal(body, &wrapped)
+	if err == nil && wrapped.Data != nil {
+		return wrapped.Data, nil
+	}
+
+	var data Data
+	err = json.Unmarshal(body, &data)
+	if err != nil {
+		return nil, errors.New("invalid world data")
+	}
+
+	return &data, nil
+}
+
+// watchPushedData lets map viewers know when a pushing server stopped sending data
+func watchPushedData(server string) {
+	cfg, _ := getServerConfig(server)
+	mutex := getIngestMutex(server)
+
+	for {
+		time.Sleep(cfg.PushTimeout / 2)
+
+		lastPushMutex.Lock()
+		last, ok := lastPush[server]
+		lastPushMutex.Unlock()
+
+		if ok && time.Now().Sub(last) < cfg.PushTimeout {
+			continue
+		}
+
+		mutex.Lock()
+		processData(server, nil, &InfoPackage{Message: "No data received from server", Status: http.StatusServiceUnavailable})
+		mutex.Unlock()
+	}
+}
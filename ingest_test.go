@@ -0,0 +1,145 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const ingestTestConfig = `
+servers:
+  c9s5:
+    token: "push-token"
+    mode: push
+  c9s6:
+    token: "poll-token"
+    url: "http://127.0.0.1:1"
+`
+
+const ingestTestDuty = `{"statusCode": 200, "data": {"police": [{"characterId": 4211, "steamIdentifier": "steam:11000010a1b2c3d"}]}}`
+
+// ingestTestServer serves the ingest routes, c9s5 starts without any pushed data
+func ingestTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	lastPushMutex.Lock()
+	delete(lastPush, "c9s5")
+	lastPushMutex.Unlock()
+
+	lastDutyMutex.Lock()
+	delete(lastDuty, "c9s5")
+	delete(dutyPrevious, "c9s5")
+	lastDutyMutex.Unlock()
+
+	r := gin.New()
+	r.POST("/ingest/:server/:type", handleIngest)
+	r.GET("/ingest/:server/socket", handleIngestSocket)
+
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func ingestDutyCount(server, department string) int {
+	lastDutyMutex.Lock()
+	defer lastDutyMutex.Unlock()
+
+	return len(lastDuty[server].Departments[department])
+}
+
+func TestIngest(t *testing.T) {
+	useTestConfig(t, ingestTestConfig)
+
+	server := ingestTestServer(t)
+	world, err := ioutil.ReadFile("testdata/synthetic_world.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path   string
+		token  string
+		body   string
+		status int
+	}{
+		{"/ingest/c9s6/world", "poll-token", string(world), http.StatusNotFound},
+		{"/ingest/c9s9/world", "push-token", string(world), http.StatusNotFound},
+		{"/ingest/c9s5/world", "poll-token", string(world), http.StatusUnauthorized},
+		{"/ingest/c9s5/world", "", string(world), http.StatusUnauthorized},
+		{"/ingest/c9s5/players", "push-token", string(world), http.StatusBadRequest},
+		{"/ingest/c9s5/world", "push-token", "{", http.StatusBadRequest},
+		{"/ingest/c9s5/duty", "push-token", `{"statusCode": 500}`, http.StatusBadRequest},
+		{"/ingest/c9s5/world", "push-token", string(world), http.StatusOK},
+		{"/ingest/c9s5/duty", "push-token", ingestTestDuty, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("POST", server.URL+test.path, strings.NewReader(test.body))
+		req.Header.Set("Authorization", "Bearer "+test.token)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+
+		if resp.StatusCode != test.status {
+			t.Errorf("%s with token %q: expected %d, got %d", test.path, test.token, test.status, resp.StatusCode)
+		}
+	}
+
+	lastPushMutex.Lock()
+	last, ok := lastPush["c9s5"]
+	pushed := time.Now().Sub(last)
+	lastPushMutex.Unlock()
+
+	if !ok || pushed > time.Minute {
+		t.Error("expected the pushed world data to be processed")
+	}
+
+	if ingestDutyCount("c9s5", "police") != 1 {
+		t.Error("expected the pushed duty list to be processed")
+	}
+}
+
+func TestIngestSocket(t *testing.T) {
+	useTestConfig(t, ingestTestConfig)
+
+	server := ingestTestServer(t)
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ingest/c9s5/socket"
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Authorization": {"Bearer poll-token"}})
+	if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatal("expected the socket to require the server token")
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Authorization": {"Bearer push-token"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	// Invalid messages are skipped without closing the connection
+	for _, message := range []string{`{"type": "players", "data": {}}`, `{"type": "duty", "data": {"statusCode": 500}}`, `{"type": "duty", "data": ` + ingestTestDuty + `}`} {
+		err = conn.WriteMessage(websocket.TextMessage, []byte(message))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); ingestDutyCount("c9s5", "police") != 1; {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the duty list sent over the socket to be processed")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -5,8 +5,6 @@ import (
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/mattn/go-colorable"
-	"github.com/rs/xid"
-	"github.com/subosito/gotenv"
 	"gitlab.com/milan44/logger"
 	"io/ioutil"
 	"math/rand"
@@ -14,8 +12,7 @@ import (
 	"os/signal"
 	"regexp"
 	"strconv"
-	"strings"
-	"sync"
+	"syscall"
 	"time"
 )
 
@@ -23,66 +20,70 @@ var (
 	ginLogger gin.HandlerFunc
 	log       logger.ShortLogger
 
-	oneTimeTokens     = make(map[string]OTT)
-	oneTimeTokenMutex sync.Mutex
-
 	vehicleAddonMap = VehicleJSON{}
-
-	SessionDirectory string
 )
 
-type OTT struct {
-	time    time.Time
-	cluster string
-}
-
 func main() {
 	_ = os.Setenv("TZ", "UTC")
 
 	log = logger.NewGinStyleLogger(false)
 
-	err := gotenv.Load(".env")
+	configFile := os.Getenv("CONFIG_FILE")
+	if configFile == "" {
+		configFile = "config.yml"
+	}
+
+	var err error
+	config, err = loadConfig(configFile)
 	if err != nil {
-		log.Error("Failed to load .env")
+		log.Error("Failed to load configuration: " + err.Error())
 		return
 	}
 
-	root := strings.TrimRight(os.Getenv("PanelRoot"), string(os.PathSeparator))
-	SessionDirectory = root + "/storage/framework/session_storage"
-	stat, err := os.Stat(SessionDirectory)
-	if err != nil || !stat.IsDir() {
-		log.Error("Failed to read PanelRoot '" + SessionDirectory + "'")
+	err = initUpstreams()
+	if err != nil {
+		log.Error("Failed to initialize upstreams: " + err.Error())
 		return
 	}
 
-	log.Debug("Using '" + SessionDirectory + "' for sessions")
+	authenticator, err = newAuthenticator(config.Auth)
+	if err != nil {
+		log.Error("Failed to initialize authentication: " + err.Error())
+		return
+	}
 
-	err = loadVehicleJSON("vehicles.json", &vehicleAddonMap)
+	log.Debug("Using " + authenticator.Name() + " for sessions")
+
+	err = loadVehicleJSON(config.VehiclesFile, &vehicleAddonMap)
 	if err != nil {
-		log.Error("Failed to load vehicles.json")
+		log.Error("Failed to load " + config.VehiclesFile)
 		log.ErrorE(err)
 		return
 	}
 
 	rand.Seed(time.Now().UnixNano())
 
+	wsupgrader.EnableCompression = config.WebsocketCompression
+
 	go func() {
 		sigc := make(chan os.Signal, 1)
 		signal.Notify(sigc,
 			os.Interrupt,
+			syscall.SIGTERM,
 		)
 
-		<-sigc
+		sig := <-sigc
+
+		log.Warning("Caught " + sig.String())
 
-		log.Warning("Caught interrupt")
+		closeAllConnections()
+
+		saveAFKState()
 
 		os.Exit(0)
 	}()
 
-	b, err := ioutil.ReadFile("afk.json")
-	if err == nil {
-		_ = json.Unmarshal(b, &lastPosition)
-	}
+	loadAFKState()
 
 	_ = doHistoryCleanup()
 
@@ -94,46 +95,64 @@ func main() {
 
 	corsConf := cors.DefaultConfig()
 	corsConf.AllowWebSockets = true
-	corsConf.AllowAllOrigins = true
 	corsConf.AllowWildcard = true
 	corsConf.AllowHeaders = append(corsConf.AllowHeaders, "x-requested-with")
 
+	if originsConfigured() {
+		corsConf.AllowOriginFunc = func(origin string) bool {
+			return originInList(origin, allOrigins())
+		}
+	} else {
+		log.Warning("No allowed origins configured, allowing all origins")
+		corsConf.AllowAllOrigins = true
+	}
+
 	r.Use(gin.Recovery())
+	r.Use(originMiddleware())
 	r.Use(cors.New(corsConf))
 	ginLogger = logger.GinLoggerMiddleware()
 
 	r.GET("/socket", func(c *gin.Context) {
-		if !checkSession(c, false) {
+		if !checkSession(c, false, PermissionMap) {
 			log.Info("Rejected unauthorized login")
 			return
 		}
 
-		handleSocket(c.Writer, c.Request, c, SocketTypeMap)
+		handleSocket(c.Writer, c.Request, c, getSession(c), SocketTypeMap)
 	})
 
 	r.GET("/staff-chat", func(c *gin.Context) {
-		if !checkSession(c, false) {
+		if !checkSession(c, false, PermissionStaffChat) {
 			log.Info("Rejected unauthorized login")
 			return
 		}
 
-		handleSocket(c.Writer, c.Request, c, SocketTypeStaffChat)
+		handleSocket(c.Writer, c.Request, c, getSession(c), SocketTypeStaffChat)
 	})
 
-	r.GET("/token", func(c *gin.Context) {
-		if !checkSession(c, true) {
+	r.GET("/duty", func(c *gin.Context) {
+		if !checkSession(c, false, PermissionMap) {
 			log.Info("Rejected unauthorized login")
 			return
 		}
 
-		token := xid.New().String()
+		handleSocket(c.Writer, c.Request, c, getSession(c), SocketTypeDuty)
+	})
 
-		oneTimeTokenMutex.Lock()
-		oneTimeTokens[token] = OTT{
-			time:    time.Now(),
-			cluster: c.Query("cluster"),
+	r.GET("/token", func(c *gin.Context) {
+		if !checkSession(c, true, "") {
+			log.Info("Rejected unauthorized login")
+			return
+		}
+
+		token, err := issueOneTimeToken(c, getSession(c))
+		if err != nil {
+			c.JSON(200, map[string]interface{}{
+				"status": false,
+				"error":  err.Error(),
+			})
+			return
 		}
-		oneTimeTokenMutex.Unlock()
 
 		c.JSON(200, map[string]interface{}{
 			"status": true,
@@ -142,11 +161,13 @@ func main() {
 	})
 
 	r.GET("/history/heatmap/:server/:day", func(c *gin.Context) {
-		if !checkSession(c, true) {
+		if !checkSession(c, true, PermissionHistory) {
 			log.Info("Rejected unauthorized login")
 			return
 		}
 
+		logAccess(c, "history/heatmap")
+
 		server := c.Param("server")
 		day := c.Param("day")
 
@@ -173,11 +194,13 @@ func main() {
 	})
 
 	r.GET("/history/track/:server/:steam/:from/:till", func(c *gin.Context) {
-		if !checkSession(c, true) {
+		if !checkSession(c, true, PermissionHistory) {
 			log.Info("Rejected unauthorized login")
 			return
 		}
 
+		logAccess(c, "history/track")
+
 		server := c.Param("server")
 		steam := c.Param("steam")
 		from, err := strconv.ParseInt(c.Param("from"), 10, 64)
@@ -216,24 +239,248 @@ func main() {
 		}
 	})
 
-	go startDataLoop()
-	go startDutyLoop()
-	go startStaffChatLoop()
+	r.GET("/afk/:server", func(c *gin.Context) {
+		if !checkSession(c, true, PermissionMap) {
+			log.Info("Rejected unauthorized login")
+			return
+		}
 
-	cert := os.Getenv("SSL_CERT")
-	key := os.Getenv("SSL_KEY")
-	log.Info("Starting server on port 9999")
+		logAccess(c, "afk/list")
 
-	err = r.RunTLS(":9999", cert, key)
-	if err != nil {
-		log.Warning("Failed to start TLS server (invalid SSL_CERT or SSL_KEY)")
-		log.Info("Starting non-TLS server on port 8080")
+		server := c.Param("server")
+		rgx := regexp.MustCompile(`(?m)^c\d+s\d+$`)
+		if !rgx.MatchString(server) {
+			c.JSON(200, map[string]interface{}{
+				"status": false,
+				"error":  "invalid server",
+			})
+			return
+		}
+
+		threshold := int64(afkThreshold().Seconds())
+		if c.Query("threshold") != "" {
+			t, err := strconv.ParseInt(c.Query("threshold"), 10, 64)
+			if err != nil || t < 0 {
+				c.JSON(200, map[string]interface{}{
+					"status": false,
+					"error":  "invalid threshold",
+				})
+				return
+			}
+
+			threshold = t
+		}
 
-		err = r.Run(":9999")
+		c.JSON(200, map[string]interface{}{
+			"status": true,
+			"data":   getAFKPlayers(server, threshold, getSession(c)),
+		})
+	})
+
+	r.GET("/afk/:server/:steam/:from/:till", func(c *gin.Context) {
+		if !checkSession(c, true, PermissionHistory) {
+			log.Info("Rejected unauthorized login")
+			return
+		}
+
+		logAccess(c, "afk/sessions")
+
+		server := c.Param("server")
+		steam := c.Param("steam")
+		from, err := strconv.ParseInt(c.Param("from"), 10, 64)
+		till, err2 := strconv.ParseInt(c.Param("till"), 10, 64)
+
+		rgx := regexp.MustCompile(`(?m)^c\d+s\d+$`)
+		if !rgx.MatchString(server) || err != nil || err2 != nil || till < from {
+			c.JSON(200, map[string]interface{}{
+				"status": false,
+				"error":  "invalid server, from or till",
+			})
+			return
+		}
+
+		sessions, err := getAFKSessions(server, steam, from, till)
 		if err != nil {
-			panic(err)
+			c.JSON(200, map[string]interface{}{
+				"status": false,
+				"error":  err.Error(),
+			})
+		} else {
+			c.JSON(200, map[string]interface{}{
+				"status": true,
+				"data":   sessions,
+			})
 		}
-		panic(err)
+	})
+
+	r.GET("/audit/flags/:server/:from/:till", func(c *gin.Context) {
+		if !checkSession(c, true, PermissionAudit) {
+			log.Info("Rejected unauthorized login")
+			return
+		}
+
+		logAccess(c, "audit/flags")
+
+		server := c.Param("server")
+		from, err := strconv.ParseInt(c.Param("from"), 10, 64)
+		till, err2 := strconv.ParseInt(c.Param("till"), 10, 64)
+
+		rgx := regexp.MustCompile(`(?m)^c\d+s\d+$`)
+		if !rgx.MatchString(server) || err != nil || err2 != nil {
+			c.JSON(200, map[string]interface{}{
+				"status": false,
+				"error":  "invalid server, from or till",
+			})
+			return
+		}
+
+		records, err := getFlagRecords(server, from, till, c.Query("flag"), c.Query("steam"))
+		if err != nil {
+			c.JSON(200, map[string]interface{}{
+				"status": false,
+				"error":  err.Error(),
+			})
+		} else {
+			c.JSON(200, map[string]interface{}{
+				"status": true,
+				"data":   records,
+			})
+		}
+	})
+
+	r.GET("/audit/access/:from/:till", func(c *gin.Context) {
+		if !checkSession(c, true, PermissionAdmin) {
+			log.Info("Rejected unauthorized login")
+			return
+		}
+
+		logAccess(c, "audit/access")
+
+		from, err := strconv.ParseInt(c.Param("from"), 10, 64)
+		till, err2 := strconv.ParseInt(c.Param("till"), 10, 64)
+
+		if err != nil || err2 != nil {
+			c.JSON(200, map[string]interface{}{
+				"status": false,
+				"error":  "invalid from or till",
+			})
+			return
+		}
+
+		entries, err := getAccessEntries(from, till, c.Query("steam"), c.Query("action"))
+		if err != nil {
+			c.JSON(200, map[string]interface{}{
+				"status": false,
+				"error":  err.Error(),
+			})
+		} else {
+			c.JSON(200, map[string]interface{}{
+				"status": true,
+				"data":   entries,
+			})
+		}
+	})
+
+	r.GET("/vehicles/unknown", func(c *gin.Context) {
+		if !checkSession(c, true, PermissionAdmin) {
+			log.Info("Rejected unauthorized login")
+			return
+		}
+
+		logAccess(c, "vehicles/unknown")
+
+		c.JSON(200, map[string]interface{}{
+			"status": true,
+			"data":   getUnknownVehicles(),
+		})
+	})
+
+	r.GET("/vehicles/history/:server/vehicle/:id/:from/:till", func(c *gin.Context) {
+		if !checkSession(c, true, PermissionAudit) {
+			log.Info("Rejected unauthorized login")
+			return
+		}
+
+		logAccess(c, "vehicles/history")
+
+		server := c.Param("server")
+		vehicleID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		from, err2 := strconv.ParseInt(c.Param("from"), 10, 64)
+		till, err3 := strconv.ParseInt(c.Param("till"), 10, 64)
+
+		rgx := regexp.MustCompile(`(?m)^c\d+s\d+$`)
+		if !rgx.MatchString(server) || err != nil || err2 != nil || err3 != nil || vehicleID <= 0 {
+			c.JSON(200, map[string]interface{}{
+				"status": false,
+				"error":  "invalid server, vehicle id, from or till",
+			})
+			return
+		}
+
+		sessions, err := getVehicleDrivers(server, from, till, vehicleID)
+		if err != nil {
+			c.JSON(200, map[string]interface{}{
+				"status": false,
+				"error":  err.Error(),
+			})
+		} else {
+			c.JSON(200, map[string]interface{}{
+				"status": true,
+				"data":   sessions,
+			})
+		}
+	})
+
+	r.GET("/vehicles/history/:server/character/:character/:from/:till", func(c *gin.Context) {
+		if !checkSession(c, true, PermissionAudit) {
+			log.Info("Rejected unauthorized login")
+			return
+		}
+
+		logAccess(c, "vehicles/history")
+
+		server := c.Param("server")
+		characterID, err := strconv.ParseInt(c.Param("character"), 10, 64)
+		from, err2 := strconv.ParseInt(c.Param("from"), 10, 64)
+		till, err3 := strconv.ParseInt(c.Param("till"), 10, 64)
+
+		rgx := regexp.MustCompile(`(?m)^c\d+s\d+$`)
+		if !rgx.MatchString(server) || err != nil || err2 != nil || err3 != nil || characterID <= 0 {
+			c.JSON(200, map[string]interface{}{
+				"status": false,
+				"error":  "invalid server, character id, from or till",
+			})
+			return
+		}
+
+		sessions, err := getCharacterVehicles(server, from, till, characterID)
+		if err != nil {
+			c.JSON(200, map[string]interface{}{
+				"status": false,
+				"error":  err.Error(),
+			})
+		} else {
+			c.JSON(200, map[string]interface{}{
+				"status": true,
+				"data":   sessions,
+			})
+		}
+	})
+
+	r.POST("/ingest/:server/:type", handleIngest)
+	r.GET("/ingest/:server/socket", handleIngestSocket)
+
+	go startOneTimeTokenSweeper()
+	go vehicleAddonMap.watch(10 * time.Second)
+	go startSchemaViolationLog()
+	go startDataLoop()
+	go startDutyLoop()
+	go startStaffChatLoop()
+
+	err = startServer(r)
+	if err != nil {
+		log.Error(err.Error())
+		os.Exit(1)
 	}
 }
 
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"gitlab.com/milan44/logger"
+	"gopkg.in/yaml.v2"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	log = logger.NewGinStyleLogger(false)
+	gin.SetMode(gin.TestMode)
+	ginLogger = func(*gin.Context) {}
+
+	os.Exit(m.Run())
+}
+
+// useTestConfig loads the given yaml config with all storage paths inside a temporary directory
+func useTestConfig(t testing.TB, yml string) {
+	t.Helper()
+
+	cfg := &Config{}
+
+	err := yaml.UnmarshalStrict([]byte(yml), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	cfg.HistoryPath = dir + "/history"
+	cfg.AuditPath = dir + "/audit"
+	cfg.AFKPath = dir + "/afk"
+	cfg.CachePath = dir + "/cache"
+	cfg.AFKStateFile = dir + "/afk.json"
+
+	cfg.applyDefaults()
+
+	config = cfg
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const (
+	FormatJSON    = "json"
+	FormatMsgpack = "msgpack"
+)
+
+// msgpackMarshal encodes a value as MessagePack. Struct fields are named by their msgpack tag and fall back to the
+// json tag, so the same single letter keys are used by both formats.
+func msgpackMarshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+
+	err := msgpackEncode(&buf, reflect.ValueOf(v))
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// transcode converts an encoded json message into the given format
+func transcode(format string, b []byte) []byte {
+	if format != FormatMsgpack {
+		return b
+	}
+
+	var v interface{}
+	err := json.Unmarshal(b, &v)
+	if err != nil {
+		return b
+	}
+
+	m, err := msgpackMarshal(v)
+	if err != nil {
+		log.Warning("Failed to encode msgpack: " + err.Error())
+		return b
+	}
+
+	return m
+}
+
+func msgpackEncode(buf *bytes.Buffer, v reflect.Value) error {
+	if !v.IsValid() {
+		buf.WriteByte(0xc0)
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			buf.WriteByte(0xc0)
+			return nil
+		}
+
+		return msgpackEncode(buf, v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		msgpackInt(buf, v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		msgpackUint(buf, v.Uint())
+	case reflect.Float32:
+		buf.WriteByte(0xca)
+		_ = binary.Write(buf, binary.BigEndian, math.Float32bits(float32(v.Float())))
+	case reflect.Float64:
+		f := v.Float()
+
+		// JSON numbers are decoded as float64, whole numbers are sent as integers again
+		if f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+			msgpackInt(buf, int64(f))
+		} else {
+			buf.WriteByte(0xcb)
+			_ = binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+		}
+	case reflect.String:
+		msgpackString(buf, v.String())
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			buf.WriteByte(0xc0)
+			return nil
+		}
+
+		msgpackHeader(buf, v.Len(), 0x90, 0xdc, 0xdd)
+
+		for i := 0; i < v.Len(); i++ {
+			err := msgpackEncode(buf, v.Index(i))
+			if err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			buf.WriteByte(0xc0)
+			return nil
+		}
+
+		if v.Type().Key().Kind() != reflect.String {
+			return errors.New("unsupported map key " + v.Type().Key().String())
+		}
+
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].String() < keys[j].String()
+		})
+
+		msgpackHeader(buf, len(keys), 0x80, 0xde, 0xdf)
+
+		for _, key := range keys {
+			msgpackString(buf, key.String())
+
+			err := msgpackEncode(buf, v.MapIndex(key))
+			if err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		return msgpackStruct(buf, v)
+	default:
+		return errors.New("unsupported type " + v.Type().String())
+	}
+
+	return nil
+}
+
+func msgpackStruct(buf *bytes.Buffer, v reflect.Value) error {
+	type field struct {
+		name  string
+		value reflect.Value
+	}
+
+	fields := make([]field, 0, v.NumField())
+
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+
+		tag, ok := f.Tag.Lookup("msgpack")
+		if !ok {
+			tag = f.Tag.Get("json")
+		}
+
+		if tag == "-" {
+			continue
+		}
+
+		parts := strings.Split(tag, ",")
+
+		name := parts[0]
+		if name == "" {
+			name = f.Name
+		}
+
+		value := v.Field(i)
+		if len(parts) > 1 && parts[1] == "omitempty" && msgpackEmpty(value) {
+			continue
+		}
+
+		fields = append(fields, field{name, value})
+	}
+
+	msgpackHeader(buf, len(fields), 0x80, 0xde, 0xdf)
+
+	for _, f := range fields {
+		msgpackString(buf, f.name)
+
+		err := msgpackEncode(buf, f.value)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// msgpackEmpty follows the omitempty rules of encoding/json
+func msgpackEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+
+	return false
+}
+
+func msgpackInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0:
+		msgpackUint(buf, uint64(i))
+	case i >= -32:
+		buf.WriteByte(byte(i))
+	case i >= math.MinInt8:
+		buf.WriteByte(0xd0)
+		buf.WriteByte(byte(i))
+	case i >= math.MinInt16:
+		buf.WriteByte(0xd1)
+		_ = binary.Write(buf, binary.BigEndian, int16(i))
+	case i >= math.MinInt32:
+		buf.WriteByte(0xd2)
+		_ = binary.Write(buf, binary.BigEndian, int32(i))
+	default:
+		buf.WriteByte(0xd3)
+		_ = binary.Write(buf, binary.BigEndian, i)
+	}
+}
+
+func msgpackUint(buf *bytes.Buffer, u uint64) {
+	switch {
+	case u <= 127:
+		buf.WriteByte(byte(u))
+	case u <= math.MaxUint8:
+		buf.WriteByte(0xcc)
+		buf.WriteByte(byte(u))
+	case u <= math.MaxUint16:
+		buf.WriteByte(0xcd)
+		_ = binary.Write(buf, binary.BigEndian, uint16(u))
+	case u <= math.MaxUint32:
+		buf.WriteByte(0xce)
+		_ = binary.Write(buf, binary.BigEndian, uint32(u))
+	default:
+		buf.WriteByte(0xcf)
+		_ = binary.Write(buf, binary.BigEndian, u)
+	}
+}
+
+func msgpackString(buf *bytes.Buffer, s string) {
+	n := len(s)
+
+	switch {
+	case n <= 31:
+		buf.WriteByte(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(0xd9)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(0xda)
+		_ = binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(0xdb)
+		_ = binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+
+	buf.WriteString(s)
+}
+
+// msgpackHeader writes the header of an array or map with n entries
+func msgpackHeader(buf *bytes.Buffer, n int, fix, b16, b32 byte) {
+	switch {
+	case n < 16:
+		buf.WriteByte(fix | byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(b16)
+		_ = binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(b32)
+		_ = binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
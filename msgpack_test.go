@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/ugorji/go/codec"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type msgpackTestFrame struct {
+	Players []CPlayer                   `json:"p"`
+	Nested  map[string]map[string]int64 `json:"n"`
+	Missing *CCharacter                 `json:"m"`
+	Empty   []string                    `json:"e"`
+
+	Negative []int64  `json:"i"`
+	Unsigned []uint64 `json:"u"`
+	Float32  float32  `json:"f"`
+	Float64  float64  `json:"d"`
+
+	Short string `json:"s"`
+	Str8  string `json:"s8"`
+	Str16 string `json:"s16"`
+	Str32 string `json:"s32"`
+
+	Array16 []int64          `json:"a16"`
+	Array32 []bool           `json:"a32"`
+	Map16   map[string]int64 `json:"m16"`
+	Map32   map[string]bool  `json:"m32"`
+}
+
+// msgpackTestHandle decodes with the struct tags used by msgpackMarshal, the msgpack tag falls back to the json tag
+func msgpackTestHandle() *codec.MsgpackHandle {
+	h := &codec.MsgpackHandle{}
+	h.TypeInfos = codec.NewTypeInfos([]string{"msgpack", "json"})
+	h.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	h.RawToString = true
+
+	return h
+}
+
+func msgpackTestDecode(t *testing.T, b []byte, dst interface{}) {
+	t.Helper()
+
+	err := codec.NewDecoderBytes(b, msgpackTestHandle()).Decode(dst)
+	if err != nil {
+		t.Fatalf("failed to decode msgpack: %s", err)
+	}
+}
+
+func newMsgpackTestFrame(t testing.TB) msgpackTestFrame {
+	useTestConfig(t, "")
+
+	players := CompressPlayers("c1s1", []Player{
+		{
+			Source:          12,
+			Name:            "Kiwi",
+			SteamIdentifier: "steam:11000010a1b2c3d",
+			Flags:           1,
+			Coords:          &Coords{X: -1037.52, Y: -2737.81, Z: 20.17},
+			Heading:         328.45,
+			Character:       &Character{ID: 4211, FullName: "Jamie Kiwi", Flags: 8},
+			InvisibleSince:  120,
+		},
+		{
+			Source:          27,
+			Name:            "Ducky",
+			SteamIdentifier: "steam:11000010d4e5f60",
+			Coords:          &Coords{X: 441.12, Y: -981.93, Z: 30.69},
+			Heading:         90.02,
+			Speed:           12.4,
+			Vehicle: &Vehicle{
+				ID:      3074,
+				Driving: true,
+				Model:   "polnspeedo",
+				Metadata: VehicleModel{
+					Model:       "polnspeedo",
+					DisplayName: "Police Speedo",
+					Class:       VehicleClassEmergency,
+					Emergency:   true,
+				},
+			},
+		},
+	})
+
+	frame := msgpackTestFrame{
+		Players: players,
+		Nested: map[string]map[string]int64{
+			"a": {"x": 1, "y": -1},
+			"b": {},
+		},
+		Empty: []string{},
+
+		Negative: []int64{-1, -32, -33, math.MinInt8, math.MinInt8 - 1, math.MinInt16, math.MinInt16 - 1, math.MinInt32, math.MinInt32 - 1, math.MinInt64},
+		Unsigned: []uint64{0, 127, 128, math.MaxUint8, math.MaxUint8 + 1, math.MaxUint16, math.MaxUint16 + 1, math.MaxUint32, math.MaxUint32 + 1, math.MaxUint64},
+		Float32:  -2737.81,
+		Float64:  math.Pi,
+
+		Short: "steam:1100001",
+		Str8:  strings.Repeat("a", 200),
+		Str16: strings.Repeat("b", 300),
+		Str32: strings.Repeat("c", 70000),
+
+		Array16: make([]int64, 20),
+		Array32: make([]bool, 70000),
+		Map16:   make(map[string]int64),
+		Map32:   make(map[string]bool),
+	}
+
+	for i := range frame.Array16 {
+		frame.Array16[i] = int64(-i * 1000)
+	}
+
+	for i := 0; i < 20; i++ {
+		frame.Map16["k"+strconv.Itoa(i)] = int64(i)
+	}
+
+	for i := 0; i < 70000; i++ {
+		frame.Map32[strconv.Itoa(i)] = i%2 == 0
+	}
+
+	return frame
+}
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	frame := newMsgpackTestFrame(t)
+
+	b, err := msgpackMarshal(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded msgpackTestFrame
+	msgpackTestDecode(t, b, &decoded)
+
+	// The movement string is only sent in json frames, binary frames send the position instead
+	for i := range frame.Players {
+		if frame.Players[i].Position == nil || frame.Players[i].Movement == "" {
+			t.Fatalf("expected player %d to have a position", i)
+		}
+
+		frame.Players[i].Movement = ""
+	}
+
+	if !reflect.DeepEqual(frame, decoded) {
+		for i := 0; i < reflect.TypeOf(frame).NumField(); i++ {
+			expected := reflect.ValueOf(frame).Field(i).Interface()
+			got := reflect.ValueOf(decoded).Field(i).Interface()
+
+			if !reflect.DeepEqual(expected, got) {
+				t.Errorf("%s differs after decoding", reflect.TypeOf(frame).Field(i).Name)
+			}
+		}
+	}
+}
+
+func TestMsgpackHeaders(t *testing.T) {
+	tests := []struct {
+		value  interface{}
+		header []byte
+	}{
+		{nil, []byte{0xc0}},
+		{(*CCharacter)(nil), []byte{0xc0}},
+		{[]string(nil), []byte{0xc0}},
+		{true, []byte{0xc3}},
+		{-32, []byte{0xe0}},
+		{-33, []byte{0xd0}},
+		{math.MinInt16, []byte{0xd1}},
+		{math.MinInt32, []byte{0xd2}},
+		{int64(math.MinInt64), []byte{0xd3}},
+		{uint64(math.MaxUint64), []byte{0xcf}},
+		{float32(1.5), []byte{0xca}},
+		{1.5, []byte{0xcb}},
+		{2.0, []byte{0x02}},
+		{strings.Repeat("a", 31), []byte{0xbf}},
+		{strings.Repeat("a", 32), []byte{0xd9, 32}},
+		{strings.Repeat("a", 256), []byte{0xda, 0x01, 0x00}},
+		{strings.Repeat("a", 65536), []byte{0xdb, 0x00, 0x01, 0x00, 0x00}},
+		{make([]int, 15), []byte{0x9f}},
+		{make([]int, 16), []byte{0xdc, 0x00, 0x10}},
+		{make([]int, 65536), []byte{0xdd, 0x00, 0x01, 0x00, 0x00}},
+		{map[string]int{}, []byte{0x80}},
+	}
+
+	for _, test := range tests {
+		b, err := msgpackMarshal(test.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(b) < len(test.header) || !reflect.DeepEqual(b[:len(test.header)], test.header) {
+			t.Errorf("%T: expected header % x, got % x", test.value, test.header, b[:len(test.header)])
+		}
+
+		var decoded interface{}
+		msgpackTestDecode(t, b, &decoded)
+	}
+}
+
+func TestMsgpackUnsupported(t *testing.T) {
+	_, err := msgpackMarshal(map[int]string{1: "a"})
+	if err == nil {
+		t.Error("expected maps without string keys to be rejected")
+	}
+
+	_, err = msgpackMarshal(make(chan int))
+	if err == nil {
+		t.Error("expected channels to be rejected")
+	}
+}
+
+// TestTranscode makes sure a json frame and its msgpack version decode to the same values
+func TestTranscode(t *testing.T) {
+	frame := newMsgpackTestFrame(t)
+
+	jsonBytes, err := json.Marshal(map[string]interface{}{
+		"p": frame.Players,
+		"n": frame.Nested,
+		"i": frame.Negative[:9],
+		"d": frame.Float64,
+		"s": frame.Str16,
+		"a": frame.Array16,
+		"x": nil,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b := transcode(FormatJSON, jsonBytes); !reflect.DeepEqual(b, jsonBytes) {
+		t.Error("expected json frames to stay untouched")
+	}
+
+	var expected interface{}
+	err = json.Unmarshal(jsonBytes, &expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded interface{}
+	msgpackTestDecode(t, transcode(FormatMsgpack, jsonBytes), &decoded)
+
+	if !reflect.DeepEqual(normalizeNumbers(expected), normalizeNumbers(decoded)) {
+		t.Errorf("transcoded frame differs:\n%v\n%v", expected, decoded)
+	}
+}
+
+// normalizeNumbers converts all numbers to float64, as whole numbers are encoded as integers
+func normalizeNumbers(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for key, entry := range value {
+			value[key] = normalizeNumbers(entry)
+		}
+	case []interface{}:
+		for i, entry := range value {
+			value[i] = normalizeNumbers(entry)
+		}
+	case int64:
+		return float64(value)
+	case uint64:
+		return float64(value)
+	case float32:
+		return float64(value)
+	}
+
+	return v
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strings"
+)
+
+// parseOrigins reads a comma separated list of origins
+func parseOrigins(list string) []string {
+	origins := make([]string, 0)
+
+	for _, origin := range strings.Split(list, ",") {
+		origin = normalizeOrigin(origin)
+
+		if origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+
+	return origins
+}
+
+func normalizeOrigin(origin string) string {
+	return strings.TrimRight(strings.ToLower(strings.TrimSpace(origin)), "/")
+}
+
+// clusterOrigins returns the origins allowed for a cluster, allowed_origins applies to all clusters and clusters.<cluster>.origins to a single one
+func clusterOrigins(cluster string) []string {
+	origins := parseOrigins(strings.Join(config.AllowedOrigins, ","))
+
+	if c, ok := config.Clusters[cluster]; ok && c != nil {
+		origins = append(origins, parseOrigins(strings.Join(c.Origins, ","))...)
+	}
+
+	return origins
+}
+
+// allOrigins returns the origins allowed for any cluster
+func allOrigins() []string {
+	origins := parseOrigins(strings.Join(config.AllowedOrigins, ","))
+
+	for _, c := range config.Clusters {
+		if c != nil {
+			origins = append(origins, parseOrigins(strings.Join(c.Origins, ","))...)
+		}
+	}
+
+	return origins
+}
+
+// originsConfigured is false if no allowlist was configured, in which case all origins are allowed like before
+func originsConfigured() bool {
+	return len(allOrigins()) > 0
+}
+
+func originInList(origin string, origins []string) bool {
+	origin = normalizeOrigin(origin)
+
+	for _, allowed := range origins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isOriginAllowed checks the origin of a request against the allowlist of its cluster, requests without an origin (non-browser clients) are allowed
+func isOriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || !originsConfigured() {
+		return true
+	}
+
+	cluster := r.URL.Query().Get("cluster")
+	if originInList(origin, clusterOrigins(cluster)) {
+		return true
+	}
+
+	log.Warning("Rejected request from origin '" + origin + "' for cluster '" + cluster + "' (" + r.URL.Path + ")")
+
+	return false
+}
+
+// originMiddleware enforces the per-cluster allowlist, as the CORS middleware only knows the origin and not the cluster
+func originMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !isOriginAllowed(c.Request) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		c.Next()
+	}
+}
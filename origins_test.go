@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOriginAllowed(t *testing.T) {
+	useTestConfig(t, `
+allowed_origins:
+  - "https://panel.example.com/"
+clusters:
+  c2:
+    origins:
+      - "HTTPS://C2.panel.example.com"
+`)
+
+	tests := []struct {
+		origin  string
+		cluster string
+		allowed bool
+	}{
+		{"", "c1", true},
+		{"https://panel.example.com", "c1", true},
+		{"https://panel.example.com", "c2", true},
+		{"https://c2.panel.example.com", "c2", true},
+		{"https://c2.panel.example.com/", "c2", true},
+		{"https://c2.panel.example.com", "c1", false},
+		{"https://evil.example.com", "c2", false},
+		{"http://panel.example.com", "c1", false},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/socket?cluster="+test.cluster, nil)
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+
+		if allowed := isOriginAllowed(r); allowed != test.allowed {
+			t.Errorf("%q for %s: expected allowed %t", test.origin, test.cluster, test.allowed)
+		}
+	}
+
+	// Without an allowlist all origins are allowed
+	useTestConfig(t, "")
+
+	r := httptest.NewRequest("GET", "/socket?cluster=c1", nil)
+	r.Header.Set("Origin", "https://evil.example.com")
+
+	if !isOriginAllowed(r) {
+		t.Error("expected all origins to be allowed without an allowlist")
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OTT is a one-time token which allows opening a socket (or calling an endpoint) once without passing the session token
+type OTT struct {
+	time    time.Time
+	cluster string
+	session *Session
+
+	// token is the session token the OTT was issued with, it is re-validated when the OTT is used
+	token string
+	ip    string
+	scope string
+}
+
+const ottLifetime = 1 * time.Minute
+
+var (
+	oneTimeTokens     = make(map[string]OTT)
+	oneTimeTokenMutex sync.Mutex
+
+	ottIssued      = make(map[string][]time.Time)
+	ottIssuedMutex sync.Mutex
+
+	errOTTRateLimit = errors.New("too many tokens requested")
+	errOTTScope     = errors.New("invalid endpoint")
+	errOTTChained   = errors.New("a session token is required")
+)
+
+// ottRateLimit is the maximum amount of tokens a single session can request per minute
+func ottRateLimit() int {
+	return config.OTT.RateLimit
+}
+
+// ottBindIP binds tokens to the IP they were requested from
+func ottBindIP() bool {
+	return config.OTT.BindIP
+}
+
+func startOneTimeTokenSweeper() {
+	for {
+		time.Sleep(30 * time.Second)
+
+		now := time.Now()
+
+		oneTimeTokenMutex.Lock()
+		for token, ott := range oneTimeTokens {
+			if now.Sub(ott.time) >= ottLifetime {
+				delete(oneTimeTokens, token)
+			}
+		}
+		oneTimeTokenMutex.Unlock()
+
+		ottIssuedMutex.Lock()
+		for id, issued := range ottIssued {
+			if len(issued) == 0 || now.Sub(issued[len(issued)-1]) >= time.Minute {
+				delete(ottIssued, id)
+			}
+		}
+		ottIssuedMutex.Unlock()
+	}
+}
+
+// issueOneTimeToken creates a new token for the authenticated session, optionally limited to a single endpoint (map, staff or history)
+func issueOneTimeToken(c *gin.Context, session *Session) (string, error) {
+	// Tokens can't be issued using another one-time token, as they couldn't be tied to a session anymore
+	if session == nil || session.token == "" {
+		return "", errOTTChained
+	}
+
+	scope := strings.ToLower(c.Query("endpoint"))
+	switch scope {
+	case "", PermissionMap, PermissionHistory, PermissionStaffChat:
+	case "staff":
+		scope = PermissionStaffChat
+	default:
+		return "", errOTTScope
+	}
+
+	now := time.Now()
+
+	ottIssuedMutex.Lock()
+	recent := make([]time.Time, 0)
+	for _, t := range ottIssued[session.ID] {
+		if now.Sub(t) < time.Minute {
+			recent = append(recent, t)
+		}
+	}
+
+	if len(recent) >= ottRateLimit() {
+		ottIssued[session.ID] = recent
+		ottIssuedMutex.Unlock()
+
+		log.Warning("Rate limited token requests of " + session.Steam)
+		return "", errOTTRateLimit
+	}
+
+	ottIssued[session.ID] = append(recent, now)
+	ottIssuedMutex.Unlock()
+
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	token := hex.EncodeToString(b)
+
+	ott := OTT{
+		time:    now,
+		cluster: c.Query("cluster"),
+		session: session,
+		token:   session.token,
+		scope:   scope,
+	}
+
+	if ottBindIP() {
+		ott.ip = c.ClientIP()
+	}
+
+	oneTimeTokenMutex.Lock()
+	oneTimeTokens[token] = ott
+	oneTimeTokenMutex.Unlock()
+
+	return token, nil
+}
+
+// useOneTimeToken consumes the given token and returns its session if it is valid for this request
+func useOneTimeToken(c *gin.Context, token, cluster, permission string) *Session {
+	if token == "" {
+		return nil
+	}
+
+	oneTimeTokenMutex.Lock()
+	ott, ok := oneTimeTokens[token]
+	delete(oneTimeTokens, token)
+	oneTimeTokenMutex.Unlock()
+
+	if !ok || time.Now().Sub(ott.time) >= ottLifetime || ott.cluster != cluster {
+		return nil
+	}
+
+	if ott.scope != "" && ott.scope != permission {
+		log.Info("Rejected one-time token of " + ott.session.Steam + " issued for '" + ott.scope + "' used for '" + permission + "'")
+		return nil
+	}
+
+	if ott.ip != "" && ott.ip != c.ClientIP() {
+		log.Warning("Rejected one-time token of " + ott.session.Steam + " issued to " + ott.ip + " used from " + c.ClientIP())
+		return nil
+	}
+
+	// Make sure the issuing session wasn't logged out in the meantime
+	if ott.token != "" {
+		session, err := authenticator.Authenticate(ott.token, cluster)
+		if err != nil || session == nil || session.ID != ott.session.ID {
+			log.Info("Rejected one-time token of " + ott.session.Steam + " as its session is no longer valid")
+			return nil
+		}
+	}
+
+	// The session token is left out, so no new tokens can be issued with a one-time token
+	session := *ott.session
+	session.token = ""
+
+	return &session
+}
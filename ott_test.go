@@ -0,0 +1,190 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// useTestSession stores a panel session for c1 and authenticates against it, the returned function logs it out
+func useTestSession(t *testing.T) (*Session, func()) {
+	t.Helper()
+
+	root := t.TempDir()
+	directory := root + "/storage/framework/session_storage"
+
+	err := os.MkdirAll(directory, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := directory + "/c1abc123.session"
+
+	err = ioutil.WriteFile(path, []byte(`{"steam": "steam:11000010a1b2c3d", "name": "Kiwi", "role": "staff"}`), 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := authenticator
+	t.Cleanup(func() {
+		authenticator = previous
+	})
+
+	authenticator, err = newFileAuthenticator(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session, err := authenticator.Authenticate("abc123", "c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.token = "abc123"
+
+	ottIssuedMutex.Lock()
+	delete(ottIssued, session.ID)
+	ottIssuedMutex.Unlock()
+
+	return session, func() {
+		_ = os.Remove(path)
+	}
+}
+
+func ottTestContext(query, ip string) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+
+	c.Request = httptest.NewRequest("GET", "/token?"+query, nil)
+	c.Request.RemoteAddr = ip + ":51234"
+
+	return c
+}
+
+func TestOneTimeTokenSingleUse(t *testing.T) {
+	useTestConfig(t, "")
+
+	session, logout := useTestSession(t)
+
+	token, err := issueOneTimeToken(ottTestContext("cluster=c1", "10.0.0.1"), session)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(token) != 64 {
+		t.Errorf("expected 32 random bytes, got %q", token)
+	}
+
+	c := ottTestContext("", "10.0.0.2")
+
+	used := useOneTimeToken(c, token, "c1", PermissionMap)
+	if used == nil || used.Steam != session.Steam {
+		t.Fatalf("expected the token to authenticate the session, got %+v", used)
+	}
+
+	if useOneTimeToken(c, token, "c1", PermissionMap) != nil {
+		t.Error("expected the token to only be usable once")
+	}
+
+	// Tokens are bound to their cluster and consumed by failed attempts as well
+	token, _ = issueOneTimeToken(ottTestContext("cluster=c1", "10.0.0.1"), session)
+
+	if useOneTimeToken(c, token, "c2", PermissionMap) != nil || useOneTimeToken(c, token, "c1", PermissionMap) != nil {
+		t.Error("expected the token to be rejected for another cluster and consumed")
+	}
+
+	// Expired tokens
+	token, _ = issueOneTimeToken(ottTestContext("cluster=c1", "10.0.0.1"), session)
+
+	oneTimeTokenMutex.Lock()
+	ott := oneTimeTokens[token]
+	ott.time = time.Now().Add(-ottLifetime)
+	oneTimeTokens[token] = ott
+	oneTimeTokenMutex.Unlock()
+
+	if useOneTimeToken(c, token, "c1", PermissionMap) != nil {
+		t.Error("expected expired tokens to be rejected")
+	}
+
+	// Tokens of sessions that logged out in the meantime
+	token, _ = issueOneTimeToken(ottTestContext("cluster=c1", "10.0.0.1"), session)
+	logout()
+
+	if useOneTimeToken(c, token, "c1", PermissionMap) != nil {
+		t.Error("expected tokens of logged out sessions to be rejected")
+	}
+
+	// Tokens can't be issued with a one-time token
+	if _, err = issueOneTimeToken(ottTestContext("cluster=c1", "10.0.0.1"), used); err != errOTTChained {
+		t.Errorf("expected chained tokens to be rejected, got %v", err)
+	}
+}
+
+func TestOneTimeTokenScope(t *testing.T) {
+	useTestConfig(t, "")
+
+	session, _ := useTestSession(t)
+	c := ottTestContext("", "10.0.0.1")
+
+	tests := []struct {
+		endpoint   string
+		permission string
+		valid      bool
+	}{
+		{"map", PermissionMap, true},
+		{"map", PermissionHistory, false},
+		{"staff", PermissionStaffChat, true},
+		{"staff", PermissionMap, false},
+		{"history", PermissionHistory, true},
+		{"", PermissionHistory, true},
+	}
+
+	for _, test := range tests {
+		token, err := issueOneTimeToken(ottTestContext("cluster=c1&endpoint="+test.endpoint, "10.0.0.1"), session)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if used := useOneTimeToken(c, token, "c1", test.permission); (used != nil) != test.valid {
+			t.Errorf("token for %q used for %q: expected valid %t", test.endpoint, test.permission, test.valid)
+		}
+	}
+
+	if _, err := issueOneTimeToken(ottTestContext("cluster=c1&endpoint=admin", "10.0.0.1"), session); err != errOTTScope {
+		t.Errorf("expected unknown endpoints to be rejected, got %v", err)
+	}
+}
+
+func TestOneTimeTokenBinding(t *testing.T) {
+	useTestConfig(t, `
+one_time_tokens:
+  rate_limit: 2
+  bind_ip: true
+`)
+
+	session, _ := useTestSession(t)
+
+	token, _ := issueOneTimeToken(ottTestContext("cluster=c1", "10.0.0.1"), session)
+	if useOneTimeToken(ottTestContext("", "10.0.0.2"), token, "c1", PermissionMap) != nil {
+		t.Error("expected the token to be bound to the IP it was requested from")
+	}
+
+	token, _ = issueOneTimeToken(ottTestContext("cluster=c1", "10.0.0.1"), session)
+	if useOneTimeToken(ottTestContext("", "10.0.0.1"), token, "c1", PermissionMap) == nil {
+		t.Error("expected the token to be valid from the IP it was requested from")
+	}
+
+	_, err := issueOneTimeToken(ottTestContext("cluster=c1", "10.0.0.1"), session)
+	if err != errOTTRateLimit {
+		t.Errorf("expected the third token within a minute to be rate limited, got %v", err)
+	}
+
+	ottIssuedMutex.Lock()
+	ottIssued[session.ID] = []time.Time{time.Now().Add(-2 * time.Minute), time.Now().Add(-time.Minute)}
+	ottIssuedMutex.Unlock()
+
+	if _, err = issueOneTimeToken(ottTestContext("cluster=c1", "10.0.0.1"), session); err != nil {
+		t.Errorf("expected older tokens not to count towards the rate limit, got %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"strings"
+)
+
+const (
+	PermissionMap       = "map"
+	PermissionStaffChat = "staff_chat"
+	PermissionHistory   = "history"
+	PermissionInvisible = "invisible"
+	PermissionAudit     = "audit"
+	PermissionAdmin     = "admin"
+
+	RoleTrial      = "trial"
+	RoleStaff      = "staff"
+	RoleSenior     = "senior"
+	RoleSuperAdmin = "superadmin"
+)
+
+var defaultRolePermissions = map[string][]string{
+	RoleTrial:      {PermissionMap},
+	RoleStaff:      {PermissionMap, PermissionStaffChat, PermissionHistory},
+	RoleSenior:     {PermissionMap, PermissionStaffChat, PermissionHistory, PermissionInvisible, PermissionAudit},
+	RoleSuperAdmin: {PermissionMap, PermissionStaffChat, PermissionHistory, PermissionInvisible, PermissionAudit, PermissionAdmin},
+}
+
+// grantedRole is used for sessions that don't carry a role, it is either granted to the steam identifier in auth.roles or the default role
+func grantedRole(steam string) string {
+	role, ok := config.Auth.Roles[strings.ToLower(steam)]
+	if ok {
+		return role
+	}
+
+	return config.Auth.DefaultRole
+}
+
+// parseRoles reads a comma separated list of steam=role grants
+func parseRoles(list string) map[string]string {
+	roles := make(map[string]string)
+
+	for _, grant := range strings.Split(list, ",") {
+		index := strings.LastIndex(grant, "=")
+		if index == -1 {
+			continue
+		}
+
+		steam := strings.TrimSpace(grant[:index])
+		role := strings.TrimSpace(grant[index+1:])
+
+		if steam != "" && role != "" {
+			roles[steam] = role
+		}
+	}
+
+	return roles
+}
+
+// rolePermissions returns the permissions of a role, which can be overridden in the auth.permissions config
+func rolePermissions(role string) []string {
+	override, ok := config.Auth.Permissions[role]
+	if ok {
+		permissions := make([]string, 0)
+
+		for _, permission := range override {
+			permission = strings.TrimSpace(permission)
+
+			if permission != "" {
+				permissions = append(permissions, permission)
+			}
+		}
+
+		return permissions
+	}
+
+	return defaultRolePermissions[role]
+}
+
+func resolvePermissions(roles []string) map[string]bool {
+	permissions := make(map[string]bool)
+
+	for _, role := range roles {
+		for _, permission := range rolePermissions(role) {
+			permissions[permission] = true
+		}
+	}
+
+	return permissions
+}
+
+func (s *Session) Can(permission string) bool {
+	if s == nil {
+		return false
+	}
+
+	return s.Permissions[permission]
+}
+
+// rolesFromClaims reads either a single "role" or a list of "roles" from the session data
+func rolesFromClaims(claims map[string]interface{}, steam string) []string {
+	roles := make([]string, 0)
+
+	if role, ok := claims["role"].(string); ok && role != "" {
+		roles = append(roles, strings.ToLower(role))
+	}
+
+	if list, ok := claims["roles"].([]interface{}); ok {
+		for _, r := range list {
+			if role, ok := r.(string); ok && role != "" {
+				roles = append(roles, strings.ToLower(role))
+			}
+		}
+	}
+
+	if len(roles) == 0 {
+		roles = append(roles, grantedRole(steam))
+	}
+
+	return roles
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// Breaker tracks the failures of one endpoint of one server and decides when it may be requested again
+type Breaker struct {
+	Server   string
+	Endpoint string
+
+	mutex    sync.Mutex
+	failures int
+	until    time.Time
+}
+
+// BreakerState is sent to clients as part of an InfoPackage
+type BreakerState struct {
+	Endpoint string `json:"endpoint"`
+	State    string `json:"state"`
+	Failures int    `json:"failures"`
+	RetryIn  int64  `json:"retryIn"`
+}
+
+var (
+	breakers      = make(map[string]*Breaker)
+	breakersMutex sync.Mutex
+)
+
+func getBreaker(server, endpoint string) *Breaker {
+	breakersMutex.Lock()
+	defer breakersMutex.Unlock()
+
+	key := server + "/" + endpoint
+
+	b, ok := breakers[key]
+	if !ok {
+		b = &Breaker{
+			Server:   server,
+			Endpoint: endpoint,
+		}
+
+		breakers[key] = b
+	}
+
+	return b
+}
+
+// Wait returns how long requests have to wait before the endpoint may be requested again
+func (b *Breaker) Wait() time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	wait := time.Until(b.until)
+	if wait < 0 {
+		return 0
+	}
+
+	return wait
+}
+
+// Allow reports whether a request may be sent right now
+func (b *Breaker) Allow() bool {
+	return b.Wait() == 0
+}
+
+// Delay returns how long a polling loop should sleep before its next request
+func (b *Breaker) Delay(interval time.Duration) time.Duration {
+	wait := b.Wait()
+	if wait > interval {
+		return wait
+	}
+
+	return interval
+}
+
+func (b *Breaker) Success() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.failures >= config.Retry.Threshold {
+		log.Info(b.Server + " - Circuit breaker for " + b.Endpoint + " closed again")
+	}
+
+	b.failures = 0
+	b.until = time.Time{}
+}
+
+// Failure opens the breaker once the threshold of consecutive failures is reached, from then on it backs off
+// exponentially. A Retry-After sent by the server is always honoured if it is longer than the backoff.
+func (b *Breaker) Failure(retryAfter time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.failures++
+
+	delay := retryAfter
+	if b.failures >= config.Retry.Threshold {
+		if wait := backoff(b.failures - config.Retry.Threshold + 1); wait > delay {
+			delay = wait
+		}
+	}
+
+	b.until = time.Now().Add(delay)
+
+	if b.failures >= config.Retry.Threshold {
+		log.Warning(b.Server + " - Circuit breaker for " + b.Endpoint + " open, retrying in " + delay.Round(time.Second).String())
+	} else if delay > 0 {
+		log.Debug(b.Server + " - Backing off " + b.Endpoint + " for " + delay.Round(time.Second).String())
+	}
+}
+
+func (b *Breaker) State() BreakerState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	state := BreakerState{
+		Endpoint: b.Endpoint,
+		State:    BreakerClosed,
+		Failures: b.failures,
+	}
+
+	wait := time.Until(b.until)
+	if wait > 0 {
+		state.RetryIn = int64(wait.Round(time.Second) / time.Second)
+	}
+
+	if b.failures >= config.Retry.Threshold {
+		if wait > 0 {
+			state.State = BreakerOpen
+		} else {
+			state.State = BreakerHalfOpen
+		}
+	}
+
+	return state
+}
+
+// Annotate attaches the current breaker state to an info package
+func (b *Breaker) Annotate(info *InfoPackage) *InfoPackage {
+	state := b.State()
+	info.Breaker = &state
+
+	return info
+}
+
+// backoff doubles the delay with every failure after the breaker opened up to retry.max, half of it is randomized so servers don't retry in lockstep
+func backoff(failures int) time.Duration {
+	delay := config.Retry.Base
+	for i := 1; i < failures && delay < config.Retry.Max; i++ {
+		delay *= 2
+	}
+
+	if delay > config.Retry.Max {
+		delay = config.Retry.Max
+	}
+
+	if delay <= 0 {
+		return 0
+	}
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// retryAfter reads the Retry-After header, which is either a number of seconds or a http date
+func retryAfter(resp *http.Response) time.Duration {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+
+	t, err := http.ParseTime(value)
+	if err == nil {
+		return time.Until(t)
+	}
+
+	return 0
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const retryTestConfig = `
+retry:
+  base: 4s
+  max: 16s
+  threshold: 3
+`
+
+func TestBreakerStates(t *testing.T) {
+	useTestConfig(t, retryTestConfig)
+
+	b := &Breaker{Server: "c9s1", Endpoint: EndpointWorld}
+
+	// Failures below the threshold don't back off
+	b.Failure(0)
+	b.Failure(0)
+
+	if state := b.State(); state.State != BreakerClosed || state.Failures != 2 || !b.Allow() {
+		t.Fatalf("expected the breaker to stay closed, got %+v", state)
+	}
+
+	b.Failure(0)
+
+	state := b.State()
+	if state.State != BreakerOpen || b.Allow() || state.RetryIn < 2 || state.RetryIn > 4 {
+		t.Fatalf("expected the breaker to open for 2-4s, got %+v", state)
+	}
+
+	if delay := b.Delay(time.Second); delay < 2*time.Second {
+		t.Errorf("expected polling to wait for the breaker, got %s", delay)
+	}
+
+	// Once the backoff passed, a single request is let through
+	b.mutex.Lock()
+	b.until = time.Now().Add(-time.Second)
+	b.mutex.Unlock()
+
+	if state = b.State(); state.State != BreakerHalfOpen || state.RetryIn != 0 || !b.Allow() {
+		t.Fatalf("expected the breaker to be half-open, got %+v", state)
+	}
+
+	// If it fails as well, the breaker opens again for twice as long
+	b.Failure(0)
+
+	if state = b.State(); state.State != BreakerOpen || state.RetryIn < 4 || state.RetryIn > 8 {
+		t.Fatalf("expected the breaker to open for 4-8s, got %+v", state)
+	}
+
+	b.Success()
+
+	if state = b.State(); state.State != BreakerClosed || state.Failures != 0 || state.RetryIn != 0 || !b.Allow() {
+		t.Errorf("expected the breaker to close, got %+v", state)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	useTestConfig(t, retryTestConfig)
+
+	tests := []struct {
+		failures int
+		max      time.Duration
+	}{
+		{1, 4 * time.Second},
+		{2, 8 * time.Second},
+		{3, 16 * time.Second},
+		{4, 16 * time.Second},
+		{50, 16 * time.Second},
+	}
+
+	for _, test := range tests {
+		for i := 0; i < 100; i++ {
+			if delay := backoff(test.failures); delay < test.max/2 || delay > test.max {
+				t.Fatalf("backoff(%d) = %s, expected between %s and %s", test.failures, delay, test.max/2, test.max)
+			}
+		}
+	}
+}
+
+func TestBreakerRetryAfter(t *testing.T) {
+	useTestConfig(t, retryTestConfig)
+
+	b := &Breaker{Server: "c9s1", Endpoint: EndpointDuty}
+
+	// Retry-After is honoured before the breaker opens
+	b.Failure(30 * time.Second)
+
+	if state := b.State(); state.State != BreakerClosed || state.RetryIn != 30 || b.Allow() {
+		t.Fatalf("expected to wait 30s, got %+v", state)
+	}
+
+	// and if it is longer than the backoff
+	b.Failure(0)
+	b.Failure(time.Minute)
+
+	if state := b.State(); state.State != BreakerOpen || state.RetryIn != 60 {
+		t.Fatalf("expected to wait 60s, got %+v", state)
+	}
+
+	// A shorter one doesn't cut the backoff short
+	b.Failure(time.Second)
+
+	if state := b.State(); state.RetryIn < 4 {
+		t.Errorf("expected to back off for at least 4s, got %+v", state)
+	}
+
+	header := func(value string) *http.Response {
+		resp := &http.Response{Header: http.Header{}}
+		resp.Header.Set("Retry-After", value)
+
+		return resp
+	}
+
+	if wait := retryAfter(header("120")); wait != 2*time.Minute {
+		t.Errorf("expected 120 seconds, got %s", wait)
+	}
+
+	if wait := retryAfter(header(time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))); wait < 59*time.Minute || wait > time.Hour {
+		t.Errorf("expected an hour, got %s", wait)
+	}
+
+	if wait := retryAfter(header("soon")); wait != 0 {
+		t.Errorf("expected invalid values to be ignored, got %s", wait)
+	}
+}
+
+func TestRequestUpstreamBreaker(t *testing.T) {
+	var requests, failing int32 = 0, 1
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+
+		if atomic.LoadInt32(&failing) == 1 {
+			w.Header().Set("Retry-After", "120")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+
+		_, _ = w.Write([]byte(`{"statusCode": 200, "data": []}`))
+	}))
+	defer upstream.Close()
+
+	useTestConfig(t, retryTestConfig+`
+servers:
+  c9s2:
+    token: "token"
+    url: "`+upstream.URL+`"
+`)
+
+	breakersMutex.Lock()
+	delete(breakers, "c9s2/"+EndpointDuty)
+	breakersMutex.Unlock()
+
+	_, info := requestUpstream("c9s2", EndpointDuty, "/op-framework/duty.json", true)
+	if info == nil || info.Message != "Rate limited" || info.Breaker == nil || info.Breaker.RetryIn != 120 {
+		t.Fatalf("expected the rate limit to be reported with its Retry-After, got %+v", info)
+	}
+
+	// The server isn't requested again until Retry-After passed
+	_, info = requestUpstream("c9s2", EndpointDuty, "/op-framework/duty.json", true)
+	if info == nil || info.Status != http.StatusServiceUnavailable || atomic.LoadInt32(&requests) != 1 {
+		t.Fatalf("expected the request to be held back, got %+v after %d requests", info, requests)
+	}
+
+	breaker := getBreaker("c9s2", EndpointDuty)
+
+	breaker.mutex.Lock()
+	breaker.until = time.Time{}
+	breaker.mutex.Unlock()
+
+	atomic.StoreInt32(&failing, 0)
+
+	if _, info = requestUpstream("c9s2", EndpointDuty, "/op-framework/duty.json", true); info != nil {
+		t.Fatalf("expected the request to succeed, got %+v", info)
+	}
+
+	// requestUpstream leaves closing the breaker to the caller, which checks the response first
+	breaker.Success()
+
+	if state := breaker.State(); state.State != BreakerClosed || state.Failures != 0 {
+		t.Errorf("expected the breaker to be closed, got %+v", state)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// certReloader serves the current certificate and reloads it when the files change on disk
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	cert    *tls.Certificate
+	modTime time.Time
+	mutex   sync.RWMutex
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	err := r.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *certReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	r.cert = &cert
+	r.modTime = lastModified(r.certFile, r.keyFile)
+	r.mutex.Unlock()
+
+	return nil
+}
+
+func (r *certReloader) watch(interval time.Duration) {
+	watchFiles("TLS certificate", []string{r.certFile, r.keyFile}, interval, func() time.Time {
+		r.mutex.RLock()
+		defer r.mutex.RUnlock()
+
+		return r.modTime
+	}, r.load)
+}
+
+func (r *certReloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.cert, nil
+}
+
+// startServer starts the configured http and https listeners and blocks until one of them fails
+func startServer(handler http.Handler) error {
+	errs := make(chan error, 2)
+
+	serve := func(name, addr string, h http.Handler, tlsConfig *tls.Config) {
+		log.Info("Starting " + name + " server on " + addr)
+
+		server := &http.Server{
+			Addr:      addr,
+			Handler:   h,
+			TLSConfig: tlsConfig,
+		}
+
+		var err error
+		if tlsConfig != nil {
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+
+		errs <- errors.New(name + " server on " + addr + ": " + err.Error())
+	}
+
+	if !config.TLS.Enabled() {
+		go serve("http", config.Listen, handler, nil)
+
+		return <-errs
+	}
+
+	reloader, err := newCertReloader(config.TLS.Cert, config.TLS.Key)
+	if err != nil {
+		if config.TLS.Require {
+			return errors.New("failed to load TLS certificate: " + err.Error())
+		}
+
+		log.Warning("Failed to load TLS certificate (" + err.Error() + "), falling back to non-TLS on " + config.TLS.Listen)
+
+		go serve("http", config.TLS.Listen, handler, nil)
+
+		if config.Listen != "" {
+			go serve("http", config.Listen, handler, nil)
+		}
+
+		return <-errs
+	}
+
+	go reloader.watch(config.TLS.ReloadInterval)
+
+	go serve("https", config.TLS.Listen, handler, &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	})
+
+	if config.Listen != "" {
+		if config.TLS.RedirectHTTP {
+			go serve("http (redirect)", config.Listen, redirectToHTTPS(config.TLS.Listen), nil)
+		} else {
+			go serve("http", config.Listen, handler, nil)
+		}
+	}
+
+	return <-errs
+}
+
+// redirectToHTTPS redirects every request to the same host and path on the https listener
+func redirectToHTTPS(tlsListen string) http.Handler {
+	_, port, _ := net.SplitHostPort(tlsListen)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
@@ -6,7 +6,6 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/rs/xid"
 	"net/http"
-	"os"
 	"regexp"
 	"strings"
 	"sync"
@@ -17,9 +16,7 @@ var (
 	wsupgrader = websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
+		CheckOrigin:     isOriginAllowed,
 	}
 
 	serverConnections = make(map[string]map[string]*Connection)
@@ -32,17 +29,38 @@ var (
 const (
 	SocketTypeMap       = "map"
 	SocketTypeStaffChat = "staff"
+	SocketTypeDuty      = "duty"
 )
 
+// socketPingInterval is how often connections are pinged (and checked for access log splits)
+const socketPingInterval = 20 * time.Second
+
 type Connection struct {
 	*websocket.Conn
 	Mutex   sync.Mutex
 	Cluster string
 	Type    string
 	Steam   string
+	Name    string
+	Session *Session
+
+	IP          string
+	ConnectedAt time.Time
+
+	// loggedSince is the start of the part of the connection that isn't in the access log yet
+	loggedSince time.Time
+
+	// Verbose map clients receive decoded flag names
+	Verbose bool
+
+	// Format is the encoding of map frames (json or msgpack)
+	Format string
+
+	// Deflate connections rely on permessage-deflate and receive uncompressed messages instead of gzip
+	Deflate bool
 }
 
-func handleSocket(w http.ResponseWriter, r *http.Request, c *gin.Context, typ string) {
+func handleSocket(w http.ResponseWriter, r *http.Request, c *gin.Context, session *Session, typ string) {
 	conn, err := wsupgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Warning("Failed to set websocket upgrade: " + err.Error())
@@ -52,14 +70,37 @@ func handleSocket(w http.ResponseWriter, r *http.Request, c *gin.Context, typ st
 
 	server := c.Query("server")
 	rgx := regexp.MustCompile(`(?m)^c\d+s\d+$`)
+
+	// Only map frames can be sent in another format
+	format := FormatJSON
+	if typ == SocketTypeMap && c.Query("format") == FormatMsgpack {
+		format = FormatMsgpack
+	}
+
+	// Messages are already gzipped for clients which didn't ask for permessage-deflate, compressing them twice is wasted.
+	// Without a negotiated extension (e.g. stripped by a proxy) the client keeps receiving gzip.
+	deflate := c.Query("compression") == "deflate" && deflateNegotiated(r)
+	conn.EnableWriteCompression(deflate)
 	if !rgx.MatchString(server) {
 		_ = conn.Close()
 		return
 	}
 
-	steam := c.Query("steam")
+	// The identity always comes from the session, the steam parameter is only accepted if it matches
+	steam := ""
+	if session != nil {
+		steam = session.Steam
+	}
+
 	rgx = regexp.MustCompile(`(?m)^steam:.+$`)
 	if !rgx.MatchString(steam) {
+		log.Info("Rejected connection to " + server + " as the session has no steam identifier")
+		_ = conn.Close()
+		return
+	}
+
+	if query := c.Query("steam"); query != "" && query != steam {
+		log.Warning("Rejected connection to " + server + " as steam parameter '" + query + "' does not match session (" + steam + ")")
 		_ = conn.Close()
 		return
 	}
@@ -76,19 +117,19 @@ func handleSocket(w http.ResponseWriter, r *http.Request, c *gin.Context, typ st
 			Message: "Cluster invalid",
 		})
 
-		_ = conn.WriteMessage(websocket.BinaryMessage, gzipBytes(b))
+		_ = conn.WriteMessage(websocket.BinaryMessage, newPayload(b).For(deflate))
 		_ = conn.Close()
 		return
 	}
 
-	if os.Getenv(server) == "" {
+	if _, ok := getServerConfig(server); !ok {
 		log.Debug("Rejected connection to " + server + " as no token is defined")
 		b, _ := json.Marshal(InfoPackage{
 			Status:  http.StatusNotFound,
 			Message: "Not found (no token)",
 		})
 
-		_ = conn.WriteMessage(websocket.BinaryMessage, gzipBytes(b))
+		_ = conn.WriteMessage(websocket.BinaryMessage, newPayload(b).For(deflate))
 		_ = conn.Close()
 		return
 	}
@@ -99,7 +140,7 @@ func handleSocket(w http.ResponseWriter, r *http.Request, c *gin.Context, typ st
 
 	if ok && e != nil {
 		_ = conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-		_ = conn.WriteMessage(websocket.BinaryMessage, gzipBytes(e))
+		_ = conn.WriteMessage(websocket.BinaryMessage, newPayload(transcode(format, e)).For(deflate))
 	} else if typ == SocketTypeStaffChat {
 		lastStaffChatMutex.Lock()
 		b, ok := lastStaffChat[server]
@@ -107,10 +148,21 @@ func handleSocket(w http.ResponseWriter, r *http.Request, c *gin.Context, typ st
 
 		if ok {
 			_ = conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			_ = conn.WriteMessage(websocket.BinaryMessage, gzipBytes(b))
+			_ = conn.WriteMessage(websocket.BinaryMessage, newPayload(b).For(deflate))
+		}
+	} else if typ == SocketTypeDuty {
+		lastDutyUpdateMutex.Lock()
+		b, ok := lastDutyUpdate[server]
+		lastDutyUpdateMutex.Unlock()
+
+		if ok {
+			_ = conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			_ = conn.WriteMessage(websocket.BinaryMessage, newPayload(b).For(deflate))
 		}
 	}
 
+	now := time.Now()
+
 	connectionsMutex.Lock()
 	if serverConnections[server] == nil {
 		serverConnections[server] = make(map[string]*Connection)
@@ -120,16 +172,30 @@ func handleSocket(w http.ResponseWriter, r *http.Request, c *gin.Context, typ st
 		Cluster: cluster,
 		Type:    typ,
 		Steam:   steam,
+		Name:    session.Name,
+		Session: session,
+
+		IP:          c.ClientIP(),
+		ConnectedAt: now,
+		loggedSince: now,
+
+		Verbose: c.Query("verbose") == "true",
+		Format:  format,
+		Deflate: deflate,
 	}
 	serverConnections[server][connectionID] = connection
 	connectionsMutex.Unlock()
 
+	logConnectionOpen(server, connection)
+
 	if typ == SocketTypeMap {
-		log.Info("User connected to live-map (" + steam + ", " + cluster + ")")
+		log.Info("User connected to live-map (" + session.Name + ", " + steam + ", " + cluster + ")")
+
+		wakeDataLoop(server)
 	}
 
 	go func() {
-		ticker := time.NewTicker(20 * time.Second)
+		ticker := time.NewTicker(socketPingInterval)
 		defer func() {
 			ticker.Stop()
 			killConnection(server, connectionID)
@@ -142,6 +208,8 @@ func handleSocket(w http.ResponseWriter, r *http.Request, c *gin.Context, typ st
 				err := conn.WriteMessage(websocket.PingMessage, nil)
 				connection.Mutex.Unlock()
 
+				splitConnectionAccess(server, connection, time.Now())
+
 				if err != nil {
 					killConnection(server, connectionID)
 					return
@@ -151,47 +219,72 @@ func handleSocket(w http.ResponseWriter, r *http.Request, c *gin.Context, typ st
 	}()
 }
 
-func broadcastToSocket(server string, data []byte, typ string) {
-	connectionsMutex.Lock()
-	connections, ok := serverConnections[server]
-	connectionsMutex.Unlock()
-
-	if !ok || len(connections) == 0 {
-		return
+// deflateNegotiated reports whether the upgrade accepted permessage-deflate, which wsupgrader does if compression is
+// enabled and the client offered the extension
+func deflateNegotiated(r *http.Request) bool {
+	if !wsupgrader.EnableCompression {
+		return false
 	}
 
-	for id, conn := range connections {
-		if conn != nil {
-			if conn.Type != typ {
-				continue
+	for _, header := range r.Header.Values("Sec-WebSocket-Extensions") {
+		for _, extension := range strings.Split(header, ",") {
+			name := strings.TrimSpace(strings.SplitN(extension, ";", 2)[0])
+
+			if name == "permessage-deflate" {
+				return true
 			}
+		}
+	}
 
-			conn.Mutex.Lock()
-			_ = conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			_ = conn.WriteMessage(websocket.BinaryMessage, data)
-			conn.Mutex.Unlock()
-		} else {
-			delete(serverConnections[server], id)
+	return false
+}
+
+func broadcastToSocket(server string, data []byte, typ string) {
+	p := newPayload(data)
+
+	broadcastToSocketFunc(server, typ, func(_ *Connection) *Payload {
+		return p
+	})
+}
+
+// broadcastToSocketFunc sends a payload to every connection of the given type, payload returns the data for each connection (nil to skip it)
+func broadcastToSocketFunc(server, typ string, payload func(*Connection) *Payload) {
+	for _, conn := range socketConnections(server, typ) {
+		data := payload(conn)
+		if data == nil {
+			continue
 		}
+
+		conn.Mutex.Lock()
+		_ = conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		_ = conn.WriteMessage(websocket.BinaryMessage, data.For(conn.Deflate))
+		conn.Mutex.Unlock()
 	}
 }
 
 func hasSocketConnections(server, typ string) bool {
+	return len(socketConnections(server, typ)) > 0
+}
+
+// socketConnections copies the connections of the given type, so they can be used without holding connectionsMutex
+func socketConnections(server, typ string) []*Connection {
 	connectionsMutex.Lock()
-	connections, ok := serverConnections[server]
-	connectionsMutex.Unlock()
+	defer connectionsMutex.Unlock()
 
-	if !ok || len(connections) == 0 {
-		return false
-	}
+	list := make([]*Connection, 0, len(serverConnections[server]))
+
+	for id, conn := range serverConnections[server] {
+		if conn == nil {
+			delete(serverConnections[server], id)
+			continue
+		}
 
-	for _, conn := range connections {
-		if conn != nil && conn.Type == typ {
-			return true
+		if conn.Type == typ {
+			list = append(list, conn)
 		}
 	}
 
-	return false
+	return list
 }
 
 func killConnection(server string, connectionID string) {
@@ -214,5 +307,25 @@ func killConnection(server string, connectionID string) {
 
 	_ = conn.Close()
 
-	log.Info("Disconnected socket client " + ip + " (" + conn.Type + ", " + conn.Cluster + ", " + conn.Steam + ")")
+	logConnectionAccess(server, conn)
+
+	log.Info("Disconnected socket client " + ip + " (" + conn.Type + ", " + conn.Cluster + ", " + conn.Name + ", " + conn.Steam + ")")
+}
+
+// closeAllConnections closes every open socket, so their access log entries are written before shutting down
+func closeAllConnections() {
+	connectionsMutex.Lock()
+	ids := make(map[string][]string)
+	for server, connections := range serverConnections {
+		for connectionID := range connections {
+			ids[server] = append(ids[server], connectionID)
+		}
+	}
+	connectionsMutex.Unlock()
+
+	for server, list := range ids {
+		for _, connectionID := range list {
+			killConnection(server, connectionID)
+		}
+	}
 }
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestSocketConnectionsConcurrentAccess reads the connections while others connect and disconnect, run it with -race
+// to catch iterations over serverConnections without holding connectionsMutex
+func TestSocketConnectionsConcurrentAccess(t *testing.T) {
+	server := "c9s3"
+
+	connectionsMutex.Lock()
+	serverConnections[server] = map[string]*Connection{
+		"viewer": {Type: SocketTypeMap, Steam: "steam:1"},
+	}
+	connectionsMutex.Unlock()
+
+	defer func() {
+		connectionsMutex.Lock()
+		delete(serverConnections, server)
+		connectionsMutex.Unlock()
+	}()
+
+	var wg sync.WaitGroup
+	done := make(chan bool)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for i := 0; i < 20000; i++ {
+			id := strconv.Itoa(i % 50)
+
+			connectionsMutex.Lock()
+			if i%2 == 0 {
+				serverConnections[server][id] = &Connection{Type: SocketTypeStaffChat}
+			} else {
+				delete(serverConnections[server], id)
+			}
+			connectionsMutex.Unlock()
+		}
+
+		close(done)
+	}()
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				if !hasSocketConnections(server, SocketTypeMap) {
+					t.Error("expected the map viewer to be connected")
+					return
+				}
+
+				if viewers := getSteamIdentifiersByTypeAndServer(SocketTypeMap, server); len(viewers) != 1 {
+					t.Errorf("expected one viewer, got %v", viewers)
+					return
+				}
+
+				broadcastToSocketFunc(server, SocketTypeDuty, func(*Connection) *Payload {
+					t.Error("expected no duty connections")
+					return nil
+				})
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+// TestDeflateNegotiated makes sure deflateNegotiated agrees with what the upgrade actually negotiated
+func TestDeflateNegotiated(t *testing.T) {
+	enabled := wsupgrader.EnableCompression
+	defer func() {
+		wsupgrader.EnableCompression = enabled
+	}()
+
+	negotiated := make(chan bool, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deflate := deflateNegotiated(r)
+
+		conn, err := wsupgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		negotiated <- deflate
+		_ = conn.Close()
+	}))
+	defer server.Close()
+
+	wsupgrader.CheckOrigin = func(*http.Request) bool {
+		return true
+	}
+	defer func() {
+		wsupgrader.CheckOrigin = isOriginAllowed
+	}()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	for _, enable := range []bool{true, false} {
+		for _, offer := range []bool{true, false} {
+			wsupgrader.EnableCompression = enable
+
+			dialer := websocket.Dialer{
+				EnableCompression: offer,
+			}
+
+			conn, resp, err := dialer.Dial(url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = conn.Close()
+
+			accepted := strings.Contains(resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate")
+
+			if deflate := <-negotiated; deflate != accepted || accepted != (enable && offer) {
+				t.Errorf("compression %t, offered %t: expected %t, got %t", enable, offer, accepted, deflate)
+			}
+		}
+	}
+}
@@ -2,14 +2,8 @@ package main
 
 import (
 	"bytes"
-	"crypto/tls"
 	"encoding/json"
-	"github.com/subosito/gotenv"
-	"io/ioutil"
 	"net/http"
-	"os"
-	"regexp"
-	"strings"
 	"sync"
 	"time"
 )
@@ -36,122 +30,92 @@ var (
 )
 
 func startStaffChatLoop() {
-	b, _ := ioutil.ReadFile(".env")
-	env := gotenv.Parse(bytes.NewReader(b))
-
-	servers := make([]string, 0)
-	for server := range env {
-		rgx := regexp.MustCompile(`(?m)^c\d+s\d+$`)
-		if rgx.MatchString(server) && os.Getenv(server) != "" {
-			servers = append(servers, server)
+	for _, s := range config.ServerNames() {
+		cfg, _ := getServerConfig(s)
+		if cfg.Mode == ModePush {
+			continue
 		}
-	}
 
-	for _, s := range servers {
 		go func(server string) {
-			for {
-				isSlow := os.Getenv(server+"_speed") == "slow"
+			breaker := getBreaker(server, EndpointStaffChat)
 
+			for {
 				if hasSocketConnections(server, SocketTypeStaffChat) {
-					staffChatList := getStaffChat(server)
+					staffChatList, info := upstreams[server].FetchStaffChat()
 
-					b, _ = json.Marshal(staffChatList)
+					processStaffChat(server, staffChatList, info)
 
-					lastStaffChatMutex.Lock()
-					lastStaffChat[server] = b
-					lastStaffChatMutex.Unlock()
-
-					broadcastToSocket(server, gzipBytes(b), SocketTypeStaffChat)
-
-					if isSlow {
-						time.Sleep(10 * time.Second)
-					} else {
-						time.Sleep(2 * time.Second)
-					}
+					time.Sleep(breaker.Delay(cfg.StaffChatInterval))
 				} else {
-					if isSlow {
-						time.Sleep(20 * time.Second)
-					} else {
-						time.Sleep(5 * time.Second)
-					}
+					time.Sleep(cfg.StaffChatIdleInterval)
 				}
 			}
 		}(s)
 	}
 }
 
-func getStaffChat(server string) []StaffChatEntry {
-	emptyList := make([]StaffChatEntry, 0)
-
-	isSlow := os.Getenv(server+"_speed") == "slow"
-
-	url := "http://" + server + ".op-framework.com/op-framework/staffChat.json"
-
-	token := os.Getenv(server)
-	if token == "" {
-		log.Error(server + " - No token defined")
-		return emptyList
+// processStaffChat stores the staff chat of a server (polled or pushed) and broadcasts it to the staff chat sockets
+func processStaffChat(server string, staffChatList []StaffChatEntry, info *InfoPackage) {
+	var b []byte
+	if info != nil {
+		b, _ = json.Marshal(info)
+	} else {
+		b, _ = json.Marshal(staffChatList)
 	}
 
-	client := &http.Client{
-		Timeout: 10 * time.Second,
-	}
+	// Clients receive the last staff chat when they connect, so unchanged chats don't have to be sent again
+	lastStaffChatMutex.Lock()
+	changed := !bytes.Equal(lastStaffChat[server], b)
+	lastStaffChat[server] = b
+	lastStaffChatMutex.Unlock()
 
-	if isSlow {
-		client.Timeout = 15 * time.Second
+	if changed {
+		broadcastToSocket(server, b, SocketTypeStaffChat)
 	}
+}
 
-	override := os.Getenv(server + "_map")
-	if override != "" {
-		if strings.Contains(override, "localhost") {
-			url = "http://" + override + "/op-framework/staffChat.json"
-		} else {
-			url = "http://" + override + "/op-framework/staffChat.json"
-		}
+func getStaffChat(server string) ([]StaffChatEntry, *InfoPackage) {
+	emptyList := make([]StaffChatEntry, 0)
 
-		client.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
-		}
-	}
+	breaker := getBreaker(server, EndpointStaffChat)
 
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		log.Error(server + " - Failed to create request: " + err.Error())
-		return emptyList
+	body, info := requestUpstream(server, EndpointStaffChat, "/op-framework/staffChat.json", true)
+	if info != nil {
+		return emptyList, info
 	}
 
-	req.Header.Set("Authorization", "Bearer "+token)
+	list, ok := parseStaffChat(server, body)
+	if !ok {
+		breaker.Failure(0)
 
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Error(server + " - Failed to do request: " + err.Error())
-		return emptyList
+		return emptyList, breaker.Annotate(&InfoPackage{Message: "Invalid response from server", Status: http.StatusBadGateway})
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Error(server + " - Failed to read body: " + err.Error())
-		return emptyList
-	}
+	breaker.Success()
+
+	return list, nil
+}
+
+// parseStaffChat reads a staffChat.json response
+func parseStaffChat(server string, body []byte) ([]StaffChatEntry, bool) {
+	emptyList := make([]StaffChatEntry, 0)
 
 	if bytes.Contains(body, []byte("\"data\":[]")) {
-		return emptyList
+		return emptyList, true
 	}
 
 	body = bytes.ReplaceAll(body, []byte("\"source\":false"), []byte("\"source\":0"))
 
 	var list StaffChatResponse
-	err = json.Unmarshal(body, &list)
+	err := json.Unmarshal(body, &list)
 	if err != nil {
 		log.Error(server + " - Failed parse response: " + err.Error())
-		return emptyList
+		return emptyList, false
 	}
 
 	if list.StatusCode != 200 {
-		return emptyList
+		return emptyList, false
 	}
 
-	return list.Data
+	return list.Data, true
 }
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// Upstream fetches the world state, duty list and staff chat of a game server, failed requests return an info package
+type Upstream interface {
+	FetchPlayers() (*Data, *InfoPackage)
+	FetchDuty() (OnDutyList, *InfoPackage)
+	FetchStaffChat() ([]StaffChatEntry, *InfoPackage)
+}
+
+const (
+	AdapterOPFramework = "op-framework"
+	AdapterJSON        = "json"
+
+	EndpointWorld     = "world"
+	EndpointDuty      = "duty"
+	EndpointStaffChat = "staff-chat"
+)
+
+var (
+	upstreams = make(map[string]Upstream)
+
+	cachedResponses      = make(map[string]*CachedResponse)
+	cachedResponsesMutex sync.Mutex
+)
+
+// CachedResponse is the last response of a conditionally requested endpoint, which is reused while the upstream answers 304
+type CachedResponse struct {
+	ETag         string
+	LastModified string
+	Body         []byte
+}
+
+// OPFrameworkUpstream polls the op-framework world.json, duty.json and staffChat.json routes
+type OPFrameworkUpstream struct {
+	server string
+}
+
+func (u *OPFrameworkUpstream) FetchPlayers() (*Data, *InfoPackage) {
+	return getData(u.server)
+}
+
+func (u *OPFrameworkUpstream) FetchDuty() (OnDutyList, *InfoPackage) {
+	return getDuty(u.server)
+}
+
+func (u *OPFrameworkUpstream) FetchStaffChat() ([]StaffChatEntry, *InfoPackage) {
+	return getStaffChat(u.server)
+}
+
+func newUpstream(server string, cfg *ServerConfig) (Upstream, error) {
+	switch cfg.Adapter {
+	case AdapterOPFramework:
+		return &OPFrameworkUpstream{
+			server: server,
+		}, nil
+	case AdapterJSON:
+		return newJSONUpstream(server, cfg)
+	}
+
+	return nil, errors.New("unknown adapter '" + cfg.Adapter + "'")
+}
+
+// initUpstreams creates the upstream adapter of every configured server, this has to happen before any loop is started
+func initUpstreams() error {
+	for _, server := range config.ServerNames() {
+		cfg, _ := getServerConfig(server)
+
+		upstream, err := newUpstream(server, cfg)
+		if err != nil {
+			return errors.New(server + ": " + err.Error())
+		}
+
+		upstreams[server] = upstream
+	}
+
+	return nil
+}
+
+// requestUpstream requests a path of a server, failed requests are counted by the circuit breaker of the endpoint.
+// Callers still have to report whether the response could be used with Success or Failure.
+// Conditional requests send the ETag/Last-Modified of the previous response and return its body if nothing changed.
+func requestUpstream(server, endpoint, path string, conditional bool) ([]byte, *InfoPackage) {
+	breaker := getBreaker(server, endpoint)
+
+	cfg, ok := getServerConfig(server)
+	if !ok {
+		log.Error(server + " - No token defined")
+		return nil, breaker.Annotate(&InfoPackage{Message: "Missing token", Status: http.StatusNotImplemented})
+	}
+
+	if !breaker.Allow() {
+		return nil, breaker.Annotate(&InfoPackage{Message: "Server unavailable, retrying later", Status: http.StatusServiceUnavailable})
+	}
+
+	url := cfg.Endpoint(path)
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		log.Error(server + " - Failed to create request: " + err.Error())
+		return nil, breaker.Annotate(&InfoPackage{Message: "Failed to get data", Status: http.StatusInternalServerError})
+	}
+	req.Header.Set("Authorization", "Bearer "+cfg.Token)
+
+	key := server + "/" + endpoint
+
+	var cached *CachedResponse
+	if conditional {
+		cachedResponsesMutex.Lock()
+		cached = cachedResponses[key]
+		cachedResponsesMutex.Unlock()
+
+		if cached != nil {
+			if cached.ETag != "" {
+				req.Header.Set("If-None-Match", cached.ETag)
+			}
+
+			if cached.LastModified != "" {
+				req.Header.Set("If-Modified-Since", cached.LastModified)
+			}
+		}
+	}
+
+	resp, err := cfg.Client().Do(req)
+	if err != nil {
+		breaker.Failure(0)
+
+		if nErr, ok := err.(net.Error); ok && nErr.Timeout() {
+			log.Error(server + " - Connection timed out")
+			return nil, breaker.Annotate(&InfoPackage{Message: "Connection timed out (likely rate-limit)", Status: http.StatusGatewayTimeout})
+		}
+
+		log.Error(server + " - Failed to do request: " + err.Error())
+		return nil, breaker.Annotate(&InfoPackage{Message: "Failed to get data", Status: http.StatusInternalServerError})
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		breaker.Failure(0)
+
+		log.Error(server + " - Failed to read body: " + err.Error())
+		return nil, breaker.Annotate(&InfoPackage{Message: "Failed to get data", Status: http.StatusInternalServerError})
+	}
+
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		return cached.Body, nil
+	}
+
+	if resp.StatusCode < 400 {
+		if conditional {
+			etag := resp.Header.Get("ETag")
+			lastModified := resp.Header.Get("Last-Modified")
+
+			cachedResponsesMutex.Lock()
+			if etag != "" || lastModified != "" {
+				cachedResponses[key] = &CachedResponse{
+					ETag:         etag,
+					LastModified: lastModified,
+					Body:         body,
+				}
+			} else {
+				delete(cachedResponses, key)
+			}
+			cachedResponsesMutex.Unlock()
+		}
+
+		return body, nil
+	}
+
+	breaker.Failure(retryAfter(resp))
+
+	var info *InfoPackage
+	switch resp.StatusCode {
+	case 401:
+		log.Warning(server + " - 401 Unauthorized (invalid token?)")
+		info = &InfoPackage{Message: "Unauthorized (server)", Status: http.StatusServiceUnavailable}
+	case 429:
+		log.Warning(server + " - 429 Too Many Requests")
+		info = &InfoPackage{Message: "Rate limited", Status: http.StatusServiceUnavailable}
+	case 504:
+		log.Warning(server + " - 504 Gateway timeout (origin error)")
+		info = &InfoPackage{Message: "Gateway timeout", Status: http.StatusServiceUnavailable}
+	case 502:
+		log.Warning(server + " - 502 Bad Gateway (origin error)")
+		info = &InfoPackage{Message: "Bad Gateway", Status: http.StatusServiceUnavailable}
+	case 521:
+		log.Warning(server + " - 521 Origin Down (server down/restarting)")
+		info = &InfoPackage{Message: "Origin Down", Status: http.StatusServiceUnavailable}
+	case 522:
+		log.Warning(server + " - 522 Origin Connection Time-out (possibly server down/restarting)")
+		info = &InfoPackage{Message: "Origin Connection Time-out", Status: http.StatusServiceUnavailable}
+	default:
+		log.Warning(server + " - " + strconv.Itoa(resp.StatusCode) + " from " + path)
+		info = &InfoPackage{Message: "Server returned " + strconv.Itoa(resp.StatusCode), Status: http.StatusServiceUnavailable}
+	}
+
+	return nil, breaker.Annotate(info)
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// MappingConfig describes where a generic JSON upstream exposes its data and how its fields map to the op-framework format
+type MappingConfig struct {
+	Players   MappedEndpoint `yaml:"players"`
+	Duty      MappedEndpoint `yaml:"duty"`
+	StaffChat MappedEndpoint `yaml:"staff_chat"`
+}
+
+type MappedEndpoint struct {
+	// Path is appended to the server url, endpoints without a path are not fetched
+	Path string `yaml:"path"`
+
+	// Root is the dot separated path to the list inside the response (empty for the response itself)
+	Root string `yaml:"root"`
+
+	// Fields maps op-framework fields to fields of the upstream, both as dot separated paths (e.g. character.fullName: char.name)
+	Fields map[string]string `yaml:"fields"`
+}
+
+// JSONUpstream polls a non op-framework server and maps its responses using the configured field mapping
+type JSONUpstream struct {
+	server  string
+	cfg     *ServerConfig
+	mapping *MappingConfig
+}
+
+func newJSONUpstream(server string, cfg *ServerConfig) (*JSONUpstream, error) {
+	if cfg.Mapping == nil || cfg.Mapping.Players.Path == "" {
+		return nil, errors.New("the json adapter requires at least mapping.players.path")
+	}
+
+	return &JSONUpstream{
+		server:  server,
+		cfg:     cfg,
+		mapping: cfg.Mapping,
+	}, nil
+}
+
+func (u *JSONUpstream) FetchPlayers() (*Data, *InfoPackage) {
+	list, info := u.fetchList(EndpointWorld, u.mapping.Players)
+	if info != nil {
+		return nil, info
+	}
+
+	data := &Data{
+		Players: make([]Player, 0, len(list)),
+	}
+
+	for _, entry := range list {
+		// Everything down the line relies on players having a steam identifier
+		player, ok := playerFromMap(mapFields(entry, u.mapping.Players.Fields))
+		if !ok {
+			continue
+		}
+
+		data.Players = append(data.Players, player)
+	}
+
+	getBreaker(u.server, EndpointWorld).Success()
+
+	return data, nil
+}
+
+func (u *JSONUpstream) FetchDuty() (OnDutyList, *InfoPackage) {
+	list := OnDutyList{
+		Departments: map[string][]OnDutyPlayer{},
+	}
+
+	if u.mapping.Duty.Path == "" {
+		return list, nil
+	}
+
+	breaker := getBreaker(u.server, EndpointDuty)
+
+	raw, info := u.fetch(EndpointDuty, u.mapping.Duty)
+	if info != nil {
+		return list, info
+	}
+
+	add := func(department string, entry interface{}) {
+		var player OnDutyPlayer
+		if !remarshal(mapFields(entry, u.mapping.Duty.Fields), &player) {
+			return
+		}
+
+		if player.Department == "" {
+			player.Department = department
+		}
+
+		if player.Department == "" {
+			return
+		}
+
+		list.Departments[player.Department] = append(list.Departments[player.Department], player)
+	}
+
+	// Duty lists are either grouped by department or a flat list with a department field
+	switch v := raw.(type) {
+	case map[string]interface{}:
+		for department, players := range v {
+			entries, _ := players.([]interface{})
+
+			for _, entry := range entries {
+				add(department, entry)
+			}
+		}
+	case []interface{}:
+		for _, entry := range v {
+			add("", entry)
+		}
+	default:
+		breaker.Failure(0)
+
+		log.Warning(u.server + " - Unexpected duty response")
+		return list, breaker.Annotate(&InfoPackage{Message: "Invalid response from server", Status: http.StatusBadGateway})
+	}
+
+	breaker.Success()
+
+	return list, nil
+}
+
+func (u *JSONUpstream) FetchStaffChat() ([]StaffChatEntry, *InfoPackage) {
+	entries := make([]StaffChatEntry, 0)
+
+	if u.mapping.StaffChat.Path == "" {
+		return entries, nil
+	}
+
+	list, info := u.fetchList(EndpointStaffChat, u.mapping.StaffChat)
+	if info != nil {
+		return entries, info
+	}
+
+	for _, raw := range list {
+		var entry StaffChatEntry
+		if remarshal(mapFields(raw, u.mapping.StaffChat.Fields), &entry) {
+			entries = append(entries, entry)
+		}
+	}
+
+	getBreaker(u.server, EndpointStaffChat).Success()
+
+	return entries, nil
+}
+
+func (u *JSONUpstream) fetchList(kind string, endpoint MappedEndpoint) ([]interface{}, *InfoPackage) {
+	raw, info := u.fetch(kind, endpoint)
+	if info != nil {
+		return nil, info
+	}
+
+	list, ok := raw.([]interface{})
+	if !ok {
+		breaker := getBreaker(u.server, kind)
+		breaker.Failure(0)
+
+		log.Warning(u.server + " - '" + endpoint.Root + "' in " + endpoint.Path + " is not a list")
+		return nil, breaker.Annotate(&InfoPackage{Message: "Invalid response from server", Status: http.StatusBadGateway})
+	}
+
+	return list, nil
+}
+
+// fetch requests a mapped endpoint and resolves its root, the caller reports success to the breaker of kind once the data is usable
+func (u *JSONUpstream) fetch(kind string, endpoint MappedEndpoint) (interface{}, *InfoPackage) {
+	breaker := getBreaker(u.server, kind)
+
+	body, info := requestUpstream(u.server, kind, endpoint.Path, kind != EndpointWorld)
+	if info != nil {
+		return nil, info
+	}
+
+	var raw interface{}
+	err := json.Unmarshal(body, &raw)
+	if err != nil {
+		breaker.Failure(0)
+
+		log.Error(u.server + " - Failed parse response: " + err.Error())
+		return nil, breaker.Annotate(&InfoPackage{Message: "Invalid response from server", Status: http.StatusBadGateway})
+	}
+
+	value, ok := lookupPath(raw, endpoint.Root)
+	if !ok {
+		breaker.Failure(0)
+
+		log.Warning(u.server + " - '" + endpoint.Root + "' not found in " + endpoint.Path)
+		return nil, breaker.Annotate(&InfoPackage{Message: "Invalid response from server", Status: http.StatusBadGateway})
+	}
+
+	return value, nil
+}
+
+// mapFields builds an op-framework style object from an upstream object, fields without a mapping are copied as they are
+func mapFields(entry interface{}, fields map[string]string) map[string]interface{} {
+	source, ok := entry.(map[string]interface{})
+	if !ok {
+		return map[string]interface{}{}
+	}
+
+	if len(fields) == 0 {
+		return source
+	}
+
+	// Mapped fields are applied to a copy, so they can't change the source fields other mappings read
+	result := copyObject(source)
+
+	// Sorted so nested targets (character, character.id) are always applied in the same order
+	targets := make([]string, 0, len(fields))
+	for target := range fields {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	for _, target := range targets {
+		value, ok := lookupPath(source, fields[target])
+		if ok {
+			setPath(result, target, value)
+		}
+	}
+
+	return result
+}
+
+func copyObject(source map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(source))
+
+	for key, value := range source {
+		if m, ok := value.(map[string]interface{}); ok {
+			value = copyObject(m)
+		}
+
+		result[key] = value
+	}
+
+	return result
+}
+
+// lookupPath resolves a dot separated path (e.g. character.fullName) inside decoded JSON
+func lookupPath(value interface{}, path string) (interface{}, bool) {
+	if path == "" {
+		return value, true
+	}
+
+	for _, key := range strings.Split(path, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+
+		value, ok = m[key]
+		if !ok {
+			return nil, false
+		}
+	}
+
+	return value, true
+}
+
+func setPath(m map[string]interface{}, path string, value interface{}) {
+	keys := strings.Split(path, ".")
+
+	for _, key := range keys[:len(keys)-1] {
+		child, ok := m[key].(map[string]interface{})
+		if !ok {
+			child = make(map[string]interface{})
+			m[key] = child
+		}
+
+		m = child
+	}
+
+	m[keys[len(keys)-1]] = value
+}
+
+// remarshal converts a mapped object into one of the typed upstream structs
+func remarshal(src interface{}, dst interface{}) bool {
+	b, err := json.Marshal(src)
+	if err != nil {
+		return false
+	}
+
+	return json.Unmarshal(b, dst) == nil
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VehicleSession is one use of a vehicle, it ends when nobody is in the vehicle anymore or someone else drives it
+type VehicleSession struct {
+	VehicleID   int64              `json:"vehicleId"`
+	Model       string             `json:"model"`
+	Steam       string             `json:"steam"`
+	CharacterID int64              `json:"characterId"`
+	Passengers  []VehiclePassenger `json:"passengers"`
+	Start       int64              `json:"start"`
+	End         int64              `json:"end"`
+	Duration    int64              `json:"duration"`
+	StartX      float64            `json:"startX"`
+	StartY      float64            `json:"startY"`
+	StartZ      float64            `json:"startZ"`
+	EndX        float64            `json:"endX"`
+	EndY        float64            `json:"endY"`
+	EndZ        float64            `json:"endZ"`
+	Active      bool               `json:"active"`
+}
+
+type VehiclePassenger struct {
+	Steam       string `json:"steam"`
+	CharacterID int64  `json:"characterId"`
+}
+
+var (
+	vehicleSessions      = make(map[string]map[int64]*VehicleSession)
+	vehicleSessionsMutex sync.Mutex
+
+	vehicleAuditFileMutex sync.Mutex
+)
+
+// trackVehicles starts, updates or ends the session of every vehicle, occupants are all players in a vehicle by its id
+func trackVehicles(server string, occupants map[int64][]Player, now int64) {
+	vehicleSessionsMutex.Lock()
+	defer vehicleSessionsMutex.Unlock()
+
+	if vehicleSessions[server] == nil {
+		vehicleSessions[server] = make(map[int64]*VehicleSession)
+	}
+
+	for id, session := range vehicleSessions[server] {
+		if len(occupants[id]) == 0 {
+			endVehicleSession(server, session, now)
+			delete(vehicleSessions[server], id)
+		}
+	}
+
+	for id, players := range occupants {
+		if id == 0 || len(players) == 0 {
+			continue
+		}
+
+		var driver *Player
+		for i := range players {
+			if players[i].Vehicle.Driving {
+				driver = &players[i]
+				break
+			}
+		}
+
+		session, tracked := vehicleSessions[server][id]
+
+		// Someone else driving the vehicle ends the current session, a driver getting in after the passengers doesn't
+		if tracked && driver != nil && session.Steam != "" && (session.Steam != driver.SteamIdentifier || session.CharacterID != getCharacterID(*driver)) {
+			endVehicleSession(server, session, now)
+			delete(vehicleSessions[server], id)
+
+			tracked = false
+		}
+
+		position := players[0].Coords
+		if driver != nil && driver.Coords != nil {
+			position = driver.Coords
+		}
+
+		if tracked && now-session.Start >= maxRecordDuration {
+			splitVehicleSession(server, session, now)
+		}
+
+		if !tracked {
+			session = &VehicleSession{
+				VehicleID:  id,
+				Passengers: make([]VehiclePassenger, 0),
+				Start:      now,
+				Active:     true,
+			}
+
+			if position != nil {
+				session.StartX = position.X
+				session.StartY = position.Y
+				session.StartZ = position.Z
+			}
+
+			vehicleSessions[server][id] = session
+		}
+
+		if driver != nil && session.Steam == "" {
+			session.Steam = driver.SteamIdentifier
+			session.CharacterID = getCharacterID(*driver)
+		}
+
+		if session.Model == "" {
+			session.Model = players[0].Vehicle.Model
+		}
+
+		for _, player := range players {
+			if player.SteamIdentifier == session.Steam && getCharacterID(player) == session.CharacterID {
+				continue
+			}
+
+			session.addPassenger(player.SteamIdentifier, getCharacterID(player))
+		}
+
+		if position != nil {
+			session.EndX = position.X
+			session.EndY = position.Y
+			session.EndZ = position.Z
+		}
+	}
+}
+
+// splitVehicleSession logs the session so far and continues it from its last position,
+// it has to be called while holding vehicleSessionsMutex
+func splitVehicleSession(server string, session *VehicleSession, now int64) {
+	finished := *session
+	finished.End = now
+	finished.Duration = now - finished.Start
+	finished.Active = false
+
+	err := logVehicleSession(server, finished)
+	if err != nil {
+		log.Warning("Failed to log session of vehicle " + strconv.FormatInt(session.VehicleID, 10) + ": " + err.Error())
+	}
+
+	session.Start = now
+	session.StartX = session.EndX
+	session.StartY = session.EndY
+	session.StartZ = session.EndZ
+}
+
+func getCharacterID(player Player) int64 {
+	if player.Character != nil {
+		return player.Character.ID
+	}
+
+	return 0
+}
+
+func (s *VehicleSession) addPassenger(steam string, characterID int64) {
+	for _, passenger := range s.Passengers {
+		if passenger.Steam == steam && passenger.CharacterID == characterID {
+			return
+		}
+	}
+
+	s.Passengers = append(s.Passengers, VehiclePassenger{
+		Steam:       steam,
+		CharacterID: characterID,
+	})
+}
+
+// usedBy reports whether the given character drove or sat in the vehicle, 0 is stored for players without a character and never matches
+func (s *VehicleSession) usedBy(characterID int64) bool {
+	if characterID <= 0 {
+		return false
+	}
+
+	if s.CharacterID == characterID {
+		return true
+	}
+
+	for _, passenger := range s.Passengers {
+		if passenger.CharacterID == characterID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// endVehicleSession has to be called while holding vehicleSessionsMutex
+func endVehicleSession(server string, session *VehicleSession, now int64) {
+	session.End = now
+	session.Duration = now - session.Start
+	session.Active = false
+
+	err := logVehicleSession(server, *session)
+	if err != nil {
+		log.Warning("Failed to log session of vehicle " + strconv.FormatInt(session.VehicleID, 10) + ": " + err.Error())
+	}
+}
+
+func logVehicleSession(server string, session VehicleSession) error {
+	dir := config.AuditPath + "/vehicles/" + server + "/"
+	path := dir + time.Unix(session.End, 0).Format("2006-01-02") + ".csv"
+
+	vehicleAuditFileMutex.Lock()
+	defer vehicleAuditFileMutex.Unlock()
+
+	_ = os.MkdirAll(dir, 0777)
+
+	_, err := os.Stat(path)
+	existed := err == nil
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0777)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	if !existed {
+		_, _ = file.WriteString("Start,End,Duration,Vehicle ID,Model,Steam,Character ID,Passengers,Start X,Start Y,Start Z,End X,End Y,End Z\n")
+	}
+
+	// Passengers are stored as steam/character pairs separated by semicolons
+	passengers := make([]string, 0, len(session.Passengers))
+	for _, passenger := range session.Passengers {
+		passengers = append(passengers, passenger.Steam+"/"+strconv.FormatInt(passenger.CharacterID, 10))
+	}
+
+	// Model names come from upstream or the vehicle file and may contain commas or quotes, so fields are escaped
+	w := csv.NewWriter(file)
+
+	err = w.Write([]string{
+		strconv.FormatInt(session.Start, 10),
+		strconv.FormatInt(session.End, 10),
+		strconv.FormatInt(session.Duration, 10),
+		strconv.FormatInt(session.VehicleID, 10),
+		session.Model,
+		session.Steam,
+		strconv.FormatInt(session.CharacterID, 10),
+		strings.Join(passengers, ";"),
+		fmt.Sprintf("%.2f", session.StartX),
+		fmt.Sprintf("%.2f", session.StartY),
+		fmt.Sprintf("%.2f", session.StartZ),
+		fmt.Sprintf("%.2f", session.EndX),
+		fmt.Sprintf("%.2f", session.EndY),
+		fmt.Sprintf("%.2f", session.EndZ),
+	})
+	if err != nil {
+		return err
+	}
+
+	w.Flush()
+
+	return w.Error()
+}
+
+// getVehicleSessions returns all finished and active vehicle sessions overlapping the given time range which match the filter
+func getVehicleSessions(server string, from, till int64, filter func(VehicleSession) bool) ([]VehicleSession, error) {
+	if till < from {
+		return nil, errors.New("till is before from")
+	}
+
+	if till-from > 31*24*60*60 {
+		return nil, errors.New("maximum range is 31 days")
+	}
+
+	matches := func(session VehicleSession) bool {
+		return session.Start <= till && session.End >= from && filter(session)
+	}
+
+	sessions := make([]VehicleSession, 0)
+
+	vehicleAuditFileMutex.Lock()
+	for _, day := range recordDays(from, till) {
+		path := config.AuditPath + "/vehicles/" + server + "/" + day.Format("2006-01-02") + ".csv"
+
+		err := readVehicleSessions(path, func(session VehicleSession) {
+			if matches(session) {
+				sessions = append(sessions, session)
+			}
+		})
+		if err != nil {
+			vehicleAuditFileMutex.Unlock()
+			return nil, err
+		}
+	}
+	vehicleAuditFileMutex.Unlock()
+
+	now := time.Now().Unix()
+
+	vehicleSessionsMutex.Lock()
+	for _, active := range vehicleSessions[server] {
+		session := *active
+		session.End = now
+		session.Duration = now - session.Start
+		session.Passengers = append([]VehiclePassenger{}, active.Passengers...)
+
+		if matches(session) {
+			sessions = append(sessions, session)
+		}
+	}
+	vehicleSessionsMutex.Unlock()
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Start < sessions[j].Start
+	})
+
+	return sessions, nil
+}
+
+// getVehicleDrivers returns every session of the given vehicle id
+func getVehicleDrivers(server string, from, till, vehicleID int64) ([]VehicleSession, error) {
+	return getVehicleSessions(server, from, till, func(session VehicleSession) bool {
+		return session.VehicleID == vehicleID
+	})
+}
+
+// getCharacterVehicles returns every session the given character drove or was a passenger in
+func getCharacterVehicles(server string, from, till, characterID int64) ([]VehicleSession, error) {
+	return getVehicleSessions(server, from, till, func(session VehicleSession) bool {
+		return session.usedBy(characterID)
+	})
+}
+
+func readVehicleSessions(path string, callback func(VehicleSession)) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.New("failed to read data")
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	// Older files were written without escaping, bare quotes in them are accepted
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+
+	index := 0
+	for {
+		elements, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			log.Warning("Failed to read vehicle csv entry: " + err.Error())
+
+			// Quoting errors only affect a single line, everything else ends the file
+			if _, ok := err.(*csv.ParseError); ok {
+				continue
+			}
+
+			break
+		}
+
+		// Skip csv header
+		if index == 0 {
+			index++
+			continue
+		}
+		index++
+
+		if len(elements) != 14 {
+			continue
+		}
+
+		var ints [5]int64
+		var floats [6]float64
+		var parseErr error
+
+		for i, element := range []string{elements[0], elements[1], elements[2], elements[3], elements[6]} {
+			ints[i], err = strconv.ParseInt(element, 10, 64)
+			if err != nil {
+				parseErr = err
+			}
+		}
+
+		for i, element := range elements[8:] {
+			floats[i], err = strconv.ParseFloat(element, 64)
+			if err != nil {
+				parseErr = err
+			}
+		}
+
+		passengers := make([]VehiclePassenger, 0)
+		if elements[7] != "" {
+			for _, entry := range strings.Split(elements[7], ";") {
+				separator := strings.LastIndex(entry, "/")
+				if separator == -1 {
+					parseErr = errors.New("invalid passenger")
+					continue
+				}
+
+				cid, err := strconv.ParseInt(entry[separator+1:], 10, 64)
+				if err != nil {
+					parseErr = err
+					continue
+				}
+
+				passengers = append(passengers, VehiclePassenger{
+					Steam:       entry[:separator],
+					CharacterID: cid,
+				})
+			}
+		}
+
+		if parseErr != nil {
+			log.Warning("Failed to read vehicle csv entry")
+			continue
+		}
+
+		callback(VehicleSession{
+			VehicleID:   ints[3],
+			Model:       elements[4],
+			Steam:       elements[5],
+			CharacterID: ints[4],
+			Passengers:  passengers,
+			Start:       ints[0],
+			End:         ints[1],
+			Duration:    ints[2],
+			StartX:      floats[0],
+			StartY:      floats[1],
+			StartZ:      floats[2],
+			EndX:        floats[3],
+			EndY:        floats[4],
+			EndZ:        floats[5],
+		})
+	}
+
+	return nil
+}
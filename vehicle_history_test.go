@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestVehicleSessionRoundTrip(t *testing.T) {
+	useTestConfig(t, "")
+
+	server := "c9s4"
+	now := time.Now().Unix()
+
+	sessions := []VehicleSession{
+		{
+			VehicleID:   3074,
+			Model:       `Police "Speedo", unmarked`,
+			Steam:       "steam:11000010a1b2c3d",
+			CharacterID: 4211,
+			Passengers:  []VehiclePassenger{{Steam: "steam:11000010d4e5f60", CharacterID: 518}},
+			Start:       now - 600,
+			End:         now - 60,
+			Duration:    540,
+			StartX:      441.12,
+			StartY:      -981.93,
+			StartZ:      30.69,
+			EndX:        -1037.52,
+			EndY:        -2737.81,
+			EndZ:        20.17,
+		},
+		{
+			VehicleID:   3075,
+			Model:       "adder",
+			Steam:       "steam:110000112345678",
+			CharacterID: 77,
+			Passengers:  []VehiclePassenger{},
+			Start:       now - 300,
+			End:         now - 30,
+			Duration:    270,
+		},
+	}
+
+	for _, session := range sessions {
+		err := logVehicleSession(server, session)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Lines of older files were written without escaping
+	old := VehicleSession{
+		VehicleID:   3076,
+		Model:       `t20 "gold"`,
+		Steam:       "steam:1",
+		CharacterID: 5,
+		Passengers:  []VehiclePassenger{},
+		Start:       now - 200,
+		End:         now - 100,
+		Duration:    100,
+	}
+
+	path := config.AuditPath + "/vehicles/" + server + "/" + time.Unix(now-30, 0).Format("2006-01-02") + ".csv"
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = file.WriteString("broken,line\n" + fmt.Sprintf("%d,%d,100,3076,t20 \"gold\",steam:1,5,,0.00,0.00,0.00,0.00,0.00,0.00\n", old.Start, old.End))
+	_ = file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := getVehicleSessions(server, now-3600, now, func(VehicleSession) bool {
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessions = append(sessions, old)
+
+	if !reflect.DeepEqual(read, sessions) {
+		b, _ := ioutil.ReadFile(path)
+		t.Errorf("expected %+v, got %+v from\n%s", sessions, read, b)
+	}
+
+	drivers, err := getVehicleDrivers(server, now-3600, now, 3074)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(drivers) != 1 || drivers[0].Model != sessions[0].Model {
+		t.Errorf("expected the escaped model name, got %+v", drivers)
+	}
+}
@@ -2,36 +2,250 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"io/ioutil"
+	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
+// VehicleJSON maps vehicle model hashes to their models, hashes are stored unsigned
 type VehicleJSON struct {
-	Data  map[string]string `json:"data"`
-	mutex sync.Mutex
+	file    string
+	models  map[uint32]VehicleModel
+	modTime time.Time
+	mutex   sync.RWMutex
 }
 
+// VehicleModel is an entry of the vehicles file, which is either just the spawn name or an object with metadata
+type VehicleModel struct {
+	Model       string `json:"model"`
+	DisplayName string `json:"name"`
+	Class       string `json:"class"`
+	Emergency   bool   `json:"emergency"`
+}
+
+const (
+	VehicleClassEmergency = "emergency"
+	VehicleClassUnknown   = "unknown"
+)
+
+type UnknownVehicle struct {
+	Hash      uint32 `json:"hash"`
+	Signed    int32  `json:"signed"`
+	FirstSeen int64  `json:"firstSeen"`
+	LastSeen  int64  `json:"lastSeen"`
+	Count     int64  `json:"count"`
+}
+
+var (
+	unknownVehicles      = make(map[uint32]*UnknownVehicle)
+	unknownVehiclesMutex sync.Mutex
+)
+
 func loadVehicleJSON(file string, dst *VehicleJSON) error {
-	b, err := ioutil.ReadFile(file)
+	dst.file = file
+
+	return dst.load()
+}
+
+func (v *VehicleJSON) load() error {
+	stat, err := os.Stat(v.file)
 	if err != nil {
 		return err
 	}
 
-	return json.Unmarshal(b, dst)
-}
+	b, err := ioutil.ReadFile(v.file)
+	if err != nil {
+		return err
+	}
 
-func (v *VehicleJSON) Find(hash string) (bool, string) {
-	_, err := strconv.ParseInt(hash, 10, 64)
+	models, err := parseVehicleJSON(b)
 	if err != nil {
-		return true, hash
+		return err
 	}
 
 	v.mutex.Lock()
-	res, ok := v.Data[hash]
+	v.models = models
+	v.modTime = stat.ModTime()
 	v.mutex.Unlock()
 
-	return ok, res
+	// Hashes which were added to the file are no longer unknown
+	unknownVehiclesMutex.Lock()
+	for hash := range unknownVehicles {
+		if _, ok := models[hash]; ok {
+			delete(unknownVehicles, hash)
+		}
+	}
+	unknownVehiclesMutex.Unlock()
+
+	return nil
+}
+
+// parseVehicleJSON reads either a hash to model map or a plain list of models, both optionally wrapped in "data".
+// Models are either spawn names or objects like {"model": "polnspeedo", "name": "Police Speedo", "class": "emergency"}.
+func parseVehicleJSON(b []byte) (map[uint32]VehicleModel, error) {
+	var wrapped struct {
+		Data json.RawMessage `json:"data"`
+	}
+
+	if json.Unmarshal(b, &wrapped) == nil && len(wrapped.Data) > 0 {
+		b = wrapped.Data
+	}
+
+	var list []json.RawMessage
+	if json.Unmarshal(b, &list) == nil {
+		models := make(map[uint32]VehicleModel, len(list))
+
+		for _, entry := range list {
+			model, err := parseVehicleModel(entry)
+			if err != nil {
+				return nil, err
+			}
+
+			if model.Model == "" {
+				return nil, errors.New("models in a list need a model name")
+			}
+
+			models[joaat(strings.ToLower(model.Model))] = model
+		}
+
+		return models, nil
+	}
+
+	var data map[string]json.RawMessage
+	err := json.Unmarshal(b, &data)
+	if err != nil {
+		return nil, errors.New("expected a map of hashes to models or a list of models")
+	}
+
+	models := make(map[uint32]VehicleModel, len(data))
+	for key, entry := range data {
+		hash, err := strconv.ParseInt(key, 10, 64)
+		if err != nil {
+			return nil, errors.New("invalid hash '" + key + "'")
+		}
+
+		model, err := parseVehicleModel(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		models[uint32(hash)] = model
+	}
+
+	return models, nil
+}
+
+func parseVehicleModel(entry json.RawMessage) (VehicleModel, error) {
+	var model VehicleModel
+
+	var name string
+	if json.Unmarshal(entry, &name) == nil {
+		model.Model = name
+	} else if err := json.Unmarshal(entry, &model); err != nil {
+		return model, errors.New("invalid model " + string(entry))
+	}
+
+	model.Class = strings.ToLower(model.Class)
+	if model.Class == VehicleClassEmergency {
+		model.Emergency = true
+	}
+
+	if model.DisplayName == "" {
+		model.DisplayName = model.Model
+	}
+
+	if model.Class == "" {
+		model.Class = VehicleClassUnknown
+	}
+
+	return model, nil
+}
+
+// watch reloads the vehicle file when it changes on disk
+func (v *VehicleJSON) watch(interval time.Duration) {
+	watchFiles(v.file, []string{v.file}, interval, func() time.Time {
+		v.mutex.RLock()
+		defer v.mutex.RUnlock()
+
+		return v.modTime
+	}, v.load)
+}
+
+// Find looks up a model hash, which may be sent signed or unsigned
+func (v *VehicleJSON) Find(hash int64) (VehicleModel, bool) {
+	v.mutex.RLock()
+	model, ok := v.models[uint32(hash)]
+	v.mutex.RUnlock()
+
+	return model, ok
+}
+
+// FindModel looks up the metadata of a spawn name, models which aren't in the registry only get the fallback
+func (v *VehicleJSON) FindModel(name string) VehicleModel {
+	model, ok := v.Find(int64(joaat(strings.ToLower(name))))
+	if !ok {
+		return fallbackVehicleModel(name)
+	}
+
+	return model
+}
+
+func fallbackVehicleModel(name string) VehicleModel {
+	return VehicleModel{
+		Model:       name,
+		DisplayName: name,
+		Class:       VehicleClassUnknown,
+	}
+}
+
+// reportUnknownVehicle counts a hash without a model name, it is only logged the first time it is seen
+func reportUnknownVehicle(hash int64) {
+	now := time.Now().Unix()
+
+	unknownVehiclesMutex.Lock()
+	defer unknownVehiclesMutex.Unlock()
+
+	vehicle, ok := unknownVehicles[uint32(hash)]
+	if !ok {
+		log.Warning("No hash mapping found for hash " + strconv.FormatInt(hash, 10))
+
+		vehicle = &UnknownVehicle{
+			Hash:      uint32(hash),
+			Signed:    int32(hash),
+			FirstSeen: now,
+		}
+
+		unknownVehicles[uint32(hash)] = vehicle
+	}
+
+	vehicle.LastSeen = now
+	vehicle.Count++
+}
+
+// getUnknownVehicles returns all unknown hashes, the most common first
+func getUnknownVehicles() []UnknownVehicle {
+	unknownVehiclesMutex.Lock()
+	defer unknownVehiclesMutex.Unlock()
+
+	vehicles := make([]UnknownVehicle, 0, len(unknownVehicles))
+	for _, vehicle := range unknownVehicles {
+		vehicles = append(vehicles, *vehicle)
+	}
+
+	sort.Slice(vehicles, func(i, j int) bool {
+		if vehicles[i].Count == vehicles[j].Count {
+			return vehicles[i].Hash < vehicles[j].Hash
+		}
+
+		return vehicles[i].Count > vehicles[j].Count
+	})
+
+	return vehicles
 }
 
 func joaat(key string) (hash uint32) {
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVehicleModelFallback(t *testing.T) {
+	models, err := parseVehicleJSON([]byte(`{"data": ["adder", {"model": "polnspeedo", "name": "Police Speedo", "class": "Emergency"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vehicles := &VehicleJSON{
+		models: models,
+	}
+
+	tests := []struct {
+		name  string
+		model VehicleModel
+	}{
+		// Models without metadata
+		{"adder", VehicleModel{Model: "adder", DisplayName: "adder", Class: VehicleClassUnknown}},
+		// Models with metadata
+		{"POLNSPEEDO", VehicleModel{Model: "polnspeedo", DisplayName: "Police Speedo", Class: VehicleClassEmergency, Emergency: true}},
+		// Models which aren't in the registry
+		{"t20", VehicleModel{Model: "t20", DisplayName: "t20", Class: VehicleClassUnknown}},
+	}
+
+	for _, test := range tests {
+		if model := vehicles.FindModel(test.name); model != test.model {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.model, model)
+		}
+	}
+
+	if _, ok := vehicles.Find(int64(joaat(strings.ToLower("t20")))); ok {
+		t.Error("expected t20 to be unmapped")
+	}
+}
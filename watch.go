@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// watchFiles calls reload whenever one of the files was modified after the time returned by loaded. A failed reload
+// keeps the old state and is retried on the next check, the files might still be in the middle of being written.
+func watchFiles(name string, files []string, interval time.Duration, loaded func() time.Time, reload func() error) {
+	for {
+		time.Sleep(interval)
+
+		if !lastModified(files...).After(loaded()) {
+			continue
+		}
+
+		err := reload()
+		if err != nil {
+			log.Warning("Failed to reload " + name + ": " + err.Error())
+			continue
+		}
+
+		log.Info("Reloaded " + name)
+	}
+}
+
+// lastModified returns the newest modification time of the given files, files that can't be read are skipped
+func lastModified(files ...string) time.Time {
+	var newest time.Time
+
+	for _, file := range files {
+		stat, err := os.Stat(file)
+		if err == nil && stat.ModTime().After(newest) {
+			newest = stat.ModTime()
+		}
+	}
+
+	return newest
+}
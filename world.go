@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Data is the world state of a server, players are decoded tolerantly so malformed entries never break a whole frame
+type Data struct {
+	Players []Player `json:"players"`
+}
+
+type Player struct {
+	Source          int64
+	Name            string
+	SteamIdentifier string
+	Flags           int64
+
+	Coords  *Coords
+	Heading float64
+	Speed   float64
+
+	Character *Character
+	Vehicle   *Vehicle
+
+	// InvisibleSince is set by extraData (in seconds)
+	InvisibleSince int64
+}
+
+type Coords struct {
+	X float64
+	Y float64
+	Z float64
+}
+
+type Character struct {
+	ID       int64
+	FullName string
+	Flags    int64
+}
+
+type Vehicle struct {
+	ID      int64
+	Driving bool
+	Name    string
+
+	// Model is the spawn name, Hash is set instead if the server only sent the model hash
+	Model string
+	Hash  int64
+
+	// Metadata is set by extraData from the vehicle registry
+	Metadata VehicleModel
+}
+
+var (
+	schemaViolations      = make(map[string]int64)
+	schemaViolationsMutex sync.Mutex
+)
+
+func (d *Data) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		Players []interface{} `json:"players"`
+	}
+
+	err := json.Unmarshal(b, &raw)
+	if err != nil {
+		return err
+	}
+
+	d.Players = make([]Player, 0, len(raw.Players))
+	for _, entry := range raw.Players {
+		player, ok := playerFromMap(entry)
+		if ok {
+			d.Players = append(d.Players, player)
+		}
+	}
+
+	return nil
+}
+
+// playerFromMap reads a decoded world.json player, players without a steam identifier are skipped
+func playerFromMap(entry interface{}) (Player, bool) {
+	m := toObject(entry, "player")
+	if m == nil {
+		return Player{}, false
+	}
+
+	steam, _ := m["steamIdentifier"].(string)
+	if steam == "" {
+		schemaViolation("player.steamIdentifier")
+		return Player{}, false
+	}
+
+	player := Player{
+		Source:          toInt64(m["source"], "player.source"),
+		Name:            toString(m["name"], "player.name"),
+		SteamIdentifier: steam,
+		Flags:           toInt64(m["flags"], "player.flags"),
+		Heading:         toFloat64(m["heading"], "player.heading"),
+		Speed:           toFloat64(m["speed"], "player.speed"),
+	}
+
+	if coords := toObject(m["coords"], "player.coords"); coords != nil {
+		x, xOk := coords["x"].(float64)
+		y, yOk := coords["y"].(float64)
+		z, zOk := coords["z"].(float64)
+
+		if xOk && yOk && zOk {
+			player.Coords = &Coords{x, y, z}
+		} else {
+			schemaViolation("player.coords")
+		}
+	}
+
+	// Players without a character or vehicle have false instead of an object
+	if character := toObject(m["character"], "player.character"); character != nil {
+		player.Character = &Character{
+			ID:       toInt64(character["id"], "character.id"),
+			FullName: toString(character["fullName"], "character.fullName"),
+			Flags:    toInt64(character["flags"], "character.flags"),
+		}
+	}
+
+	if vehicle := toObject(m["vehicle"], "player.vehicle"); vehicle != nil {
+		player.Vehicle = &Vehicle{
+			ID:      toInt64(vehicle["id"], "vehicle.id"),
+			Driving: toBool(vehicle["driving"], "vehicle.driving"),
+			Name:    toString(vehicle["name"], "vehicle.name"),
+		}
+
+		// The model is either the spawn name or its hash, which may also be sent as a string
+		switch model := vehicle["model"].(type) {
+		case float64:
+			player.Vehicle.Hash = int64(model)
+		case string:
+			hash, err := strconv.ParseInt(model, 10, 64)
+			if err == nil {
+				player.Vehicle.Hash = hash
+			} else {
+				player.Vehicle.Model = model
+			}
+		case nil:
+		default:
+			schemaViolation("vehicle.model")
+		}
+	}
+
+	return player, true
+}
+
+func schemaViolation(field string) {
+	schemaViolationsMutex.Lock()
+	schemaViolations[field]++
+	schemaViolationsMutex.Unlock()
+}
+
+// startSchemaViolationLog periodically logs a summary of the unexpected values servers sent instead of warning about every one
+func startSchemaViolationLog() {
+	for {
+		time.Sleep(10 * time.Minute)
+
+		schemaViolationsMutex.Lock()
+		counts := schemaViolations
+		schemaViolations = make(map[string]int64)
+		schemaViolationsMutex.Unlock()
+
+		if len(counts) == 0 {
+			continue
+		}
+
+		fields := make([]string, 0, len(counts))
+		for field, count := range counts {
+			fields = append(fields, fmt.Sprintf("%s (%d)", field, count))
+		}
+		sort.Strings(fields)
+
+		log.Warning("Unexpected values in world data during the last 10 minutes: " + strings.Join(fields, ", "))
+	}
+}
+
+func toObject(v interface{}, field string) map[string]interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		return value
+	case nil, bool:
+		return nil
+	}
+
+	schemaViolation(field)
+
+	return nil
+}
+
+func toInt64(v interface{}, field string) int64 {
+	switch value := v.(type) {
+	case float64:
+		return int64(value)
+	case string:
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err == nil {
+			return i
+		}
+	case nil:
+		return 0
+	}
+
+	schemaViolation(field)
+
+	return 0
+}
+
+func toFloat64(v interface{}, field string) float64 {
+	switch value := v.(type) {
+	case float64:
+		return value
+	case string:
+		f, err := strconv.ParseFloat(value, 64)
+		if err == nil {
+			return f
+		}
+	case nil:
+		return 0
+	}
+
+	schemaViolation(field)
+
+	return 0
+}
+
+func toString(v interface{}, field string) string {
+	switch value := v.(type) {
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case nil:
+		return ""
+	}
+
+	schemaViolation(field)
+
+	return ""
+}
+
+func toBool(v interface{}, field string) bool {
+	switch value := v.(type) {
+	case bool:
+		return value
+	case float64:
+		return value != 0
+	case nil:
+		return false
+	}
+
+	schemaViolation(field)
+
+	return false
+}